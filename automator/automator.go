@@ -0,0 +1,226 @@
+// Package automator watches registry repositories for newly published
+// images and triggers releases for the services that track them, so
+// nobody has to run `flux release` by hand after every build.
+package automator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/fluxy/history"
+	"github.com/weaveworks/fluxy/platform"
+	"github.com/weaveworks/fluxy/platform/helm"
+	"github.com/weaveworks/fluxy/registry"
+	"github.com/weaveworks/fluxy/subscription"
+)
+
+// repoWatcher is the minimal surface of *cache.NamespacedRepositoryCache an
+// Automator needs: a blocking subscription to a repository's image list,
+// rather than a timer the automator would have to poll itself. Expressed
+// as its own interface, the same way subscription.Releaser narrows
+// flux.Service, so tests can fake it without constructing a real cache.
+type repoWatcher interface {
+	Subscribe(repo string) <-chan []registry.Image
+}
+
+// chartReleaser is the minimal surface of *helm.Client an Automator needs
+// to amend an existing chart release with a new image tag, without
+// requiring the whole chart and values be re-specified.
+type chartReleaser interface {
+	LastRevision(namespace, service string) (helm.Chart, helm.Values, int, error)
+	Apply(namespace, service string, chart helm.Chart, values helm.Values, updatePeriod time.Duration) (int, error)
+}
+
+// Target identifies one automated service by cluster, namespace, and
+// service name. Automation is keyed on the full triple, not just
+// namespace/service, so enabling automation for "myapp" on one cluster
+// never shadows (or is shadowed by) "myapp" on another.
+type Target struct {
+	Cluster, Namespace, Service string
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("%s/%s/%s", t.Cluster, t.Namespace, t.Service)
+}
+
+// Automator watches the image repositories backing automated services and
+// releases each newly observed image as it arrives.
+type Automator struct {
+	platforms *platform.Registry
+	cache     repoWatcher
+	chart     chartReleaser
+	history   history.DB
+
+	// subs and subReconciler are only set once EnableSubscriptions has
+	// been called; until then, EnableSubscription errors out.
+	subs          subscription.Store
+	subReconciler subscriptionReconciler
+
+	mu           sync.Mutex
+	watching     map[Target]chan struct{}
+	watchingSubs map[subscriptionTarget]chan struct{}
+}
+
+// NewAutomator returns an Automator that resolves services through
+// platforms, watches their image repositories through repoCache's
+// Subscribe method rather than polling the registry itself, and releases
+// new images by bumping the image.tag of the service's most recent chart
+// release through chartClient. chartClient may be nil, in which case
+// automated services are only logged, never released: there's no chart
+// revision to amend a tag onto.
+func NewAutomator(platforms *platform.Registry, repoCache repoWatcher, chartClient *helm.Client, h history.DB) *Automator {
+	a := &Automator{
+		platforms:    platforms,
+		cache:        repoCache,
+		history:      h,
+		watching:     map[Target]chan struct{}{},
+		watchingSubs: map[subscriptionTarget]chan struct{}{},
+	}
+	if chartClient != nil {
+		a.chart = chartClient
+	}
+	return a
+}
+
+// Enable starts automatically releasing newly observed images for target.
+// It's idempotent: enabling an already-enabled target is a no-op. The
+// repository watched is whichever one the service's first container is
+// currently running, resolved once at Enable time.
+func (a *Automator) Enable(cluster, namespace, service string) error {
+	if a.cache == nil {
+		return fmt.Errorf("automator: no repository cache configured")
+	}
+
+	target := Target{cluster, namespace, service}
+
+	a.mu.Lock()
+	if _, ok := a.watching[target]; ok {
+		a.mu.Unlock()
+		return nil
+	}
+	a.mu.Unlock()
+
+	p, err := a.platforms.Get(cluster)
+	if err != nil {
+		return err
+	}
+	containers, err := p.ContainersFor(namespace, service)
+	if err != nil {
+		return err
+	}
+	if len(containers) == 0 {
+		return fmt.Errorf("automator: %s has no running containers to automate", target)
+	}
+	repo := registry.ParseImage(containers[0].Image).Repository()
+
+	stop := make(chan struct{})
+	a.mu.Lock()
+	a.watching[target] = stop
+	a.mu.Unlock()
+
+	go a.watch(target, repo, stop)
+	return nil
+}
+
+// Disable stops automatic releases for target. Disabling a target that
+// isn't enabled is a no-op.
+func (a *Automator) Disable(cluster, namespace, service string) error {
+	target := Target{cluster, namespace, service}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stop, ok := a.watching[target]
+	if !ok {
+		return nil
+	}
+	close(stop)
+	delete(a.watching, target)
+	return nil
+}
+
+// watch blocks on repo's subscription channel -- rather than polling the
+// registry on a timer -- releasing each newly observed image as it
+// arrives, until stop is closed.
+func (a *Automator) watch(target Target, repo string, stop chan struct{}) {
+	ch := a.cache.Subscribe(repo)
+	for {
+		select {
+		case images, ok := <-ch:
+			if !ok {
+				return
+			}
+			if len(images) == 0 {
+				continue
+			}
+			a.onNewImage(target, images[0])
+		case <-stop:
+			return
+		}
+	}
+}
+
+// onNewImage is called with the latest image for a watched target's
+// repository. It releases the image by bumping the image.tag value of
+// the target's most recent chart release and re-applying; a target that
+// was never chart-released (or if no chart client is configured at all)
+// is only logged, since there's no revision to amend a tag onto.
+func (a *Automator) onNewImage(target Target, image registry.Image) {
+	tag := tagOf(image)
+
+	if a.chart == nil {
+		a.history.LogEvent(target.Cluster, target.Namespace, target.Service,
+			fmt.Sprintf("automator: observed new image tag %s, but no chart client is configured to release it", tag))
+		return
+	}
+
+	chart, values, _, err := a.chart.LastRevision(target.Namespace, target.Service)
+	if err != nil {
+		a.history.LogEvent(target.Cluster, target.Namespace, target.Service,
+			fmt.Sprintf("automator: observed new image tag %s, but %v", tag, err))
+		return
+	}
+
+	if _, err := a.chart.Apply(target.Namespace, target.Service, chart, bumpImageTag(values, tag), 0); err != nil {
+		a.history.LogEvent(target.Cluster, target.Namespace, target.Service,
+			fmt.Sprintf("automator: release failed: %v", err))
+		return
+	}
+	a.history.LogEvent(target.Cluster, target.Namespace, target.Service,
+		fmt.Sprintf("automator: released image.tag %s", tag))
+}
+
+// tagOf extracts the tag portion of an image's resolved reference
+// ("repo:tag" or "repo@sha256:..."), falling back to the whole reference
+// if it has neither form.
+func tagOf(image registry.Image) string {
+	ref := image.String()
+	if i := strings.LastIndexByte(ref, '@'); i >= 0 {
+		return ref[i+1:]
+	}
+	if i := strings.LastIndexByte(ref, ':'); i >= 0 {
+		return ref[i+1:]
+	}
+	return ref
+}
+
+// bumpImageTag returns a copy of values with its nested image.tag set to
+// tag, leaving every other key -- including any other image.* overrides
+// -- untouched.
+func bumpImageTag(values helm.Values, tag string) helm.Values {
+	bumped := make(helm.Values, len(values))
+	for k, v := range values {
+		bumped[k] = v
+	}
+
+	image, _ := bumped["image"].(map[string]interface{})
+	newImage := make(map[string]interface{}, len(image)+1)
+	for k, v := range image {
+		newImage[k] = v
+	}
+	newImage["tag"] = tag
+	bumped["image"] = newImage
+
+	return bumped
+}
@@ -0,0 +1,97 @@
+package automator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weaveworks/fluxy/platform"
+	"github.com/weaveworks/fluxy/registry"
+)
+
+// fakePlatform is just enough of platform.Platform to resolve a service's
+// running image.
+type fakePlatform struct {
+	image string
+}
+
+func (f fakePlatform) Services(namespace string) ([]platform.Service, error) { return nil, nil }
+
+func (f fakePlatform) ContainersFor(namespace, service string) ([]platform.Container, error) {
+	return []platform.Container{{Image: f.image}}, nil
+}
+
+func (f fakePlatform) Release(namespace, service string, newDef []byte, updatePeriod time.Duration) error {
+	return nil
+}
+
+func (f fakePlatform) Ping() error { return nil }
+
+// fakeRepoWatcher hands back a caller-supplied channel from Subscribe and
+// records which repo was subscribed to, so tests can assert the automator
+// drives its watch off a push channel rather than polling anything.
+type fakeRepoWatcher struct {
+	subscribed []string
+	ch         chan []registry.Image
+}
+
+func (f *fakeRepoWatcher) Subscribe(repo string) <-chan []registry.Image {
+	f.subscribed = append(f.subscribed, repo)
+	return f.ch
+}
+
+func newTestAutomator(image string, watcher repoWatcher) *Automator {
+	platforms := platform.NewRegistry(map[string]platform.Platform{
+		"cluster-a": fakePlatform{image: image},
+		"cluster-b": fakePlatform{image: image},
+	}, "cluster-a")
+	return NewAutomator(platforms, watcher, nil, fakeHistory{})
+}
+
+type fakeHistory struct{}
+
+func (fakeHistory) LogEvent(cluster, namespace, service, message string) {}
+
+func TestEnableKeysByClusterNamespaceService(t *testing.T) {
+	watcher := &fakeRepoWatcher{ch: make(chan []registry.Image, 1)}
+	a := newTestAutomator("myrepo/myimage:v1", watcher)
+
+	if err := a.Enable("cluster-a", "default", "myapp"); err != nil {
+		t.Fatalf("Enable cluster-a: %v", err)
+	}
+	if err := a.Enable("cluster-b", "default", "myapp"); err != nil {
+		t.Fatalf("Enable cluster-b: %v", err)
+	}
+
+	a.mu.Lock()
+	n := len(a.watching)
+	a.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("expected 2 distinct watches for the same namespace/service on different clusters, got %d", n)
+	}
+
+	// Disabling one cluster's automation must not affect the other's.
+	if err := a.Disable("cluster-a", "default", "myapp"); err != nil {
+		t.Fatalf("Disable cluster-a: %v", err)
+	}
+	a.mu.Lock()
+	_, stillWatchingB := a.watching[Target{"cluster-b", "default", "myapp"}]
+	a.mu.Unlock()
+	if !stillWatchingB {
+		t.Fatal("disabling cluster-a's automation should not disable cluster-b's")
+	}
+}
+
+func TestEnableIsIdempotent(t *testing.T) {
+	watcher := &fakeRepoWatcher{ch: make(chan []registry.Image, 1)}
+	a := newTestAutomator("myrepo/myimage:v1", watcher)
+
+	if err := a.Enable("cluster-a", "default", "myapp"); err != nil {
+		t.Fatalf("first Enable: %v", err)
+	}
+	if err := a.Enable("cluster-a", "default", "myapp"); err != nil {
+		t.Fatalf("second Enable: %v", err)
+	}
+	if len(watcher.subscribed) != 1 {
+		t.Fatalf("expected exactly one Subscribe call for an idempotent Enable, got %d", len(watcher.subscribed))
+	}
+}
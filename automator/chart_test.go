@@ -0,0 +1,88 @@
+package automator
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/fluxy/platform/helm"
+	"github.com/weaveworks/fluxy/registry"
+)
+
+// fakeChartReleaser records the values it was asked to Apply, so tests can
+// assert only image.tag changed.
+type fakeChartReleaser struct {
+	chart   helm.Chart
+	values  helm.Values
+	applied helm.Values
+}
+
+func (f *fakeChartReleaser) LastRevision(namespace, service string) (helm.Chart, helm.Values, int, error) {
+	if f.values == nil {
+		return helm.Chart{}, nil, 0, fmt.Errorf("no revision recorded")
+	}
+	return f.chart, f.values, 1, nil
+}
+
+func (f *fakeChartReleaser) Apply(namespace, service string, chart helm.Chart, values helm.Values, updatePeriod time.Duration) (int, error) {
+	f.applied = values
+	return 2, nil
+}
+
+func TestBumpImageTagLeavesEverythingElseUntouched(t *testing.T) {
+	values := helm.Values{
+		"replicas": 3,
+		"image":    map[string]interface{}{"repository": "myrepo/myimage", "tag": "v1"},
+	}
+
+	bumped := bumpImageTag(values, "v2")
+
+	if bumped["replicas"] != 3 {
+		t.Fatalf("unrelated values should be untouched, got %+v", bumped)
+	}
+	image, ok := bumped["image"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("image value has wrong shape: %+v", bumped["image"])
+	}
+	if image["repository"] != "myrepo/myimage" {
+		t.Fatalf("image.repository should be untouched, got %v", image["repository"])
+	}
+	if image["tag"] != "v2" {
+		t.Fatalf("image.tag = %v, want v2", image["tag"])
+	}
+	if values["image"].(map[string]interface{})["tag"] != "v1" {
+		t.Fatal("bumpImageTag must not mutate the original values in place")
+	}
+}
+
+func TestOnNewImageAppliesTheBumpedChart(t *testing.T) {
+	releaser := &fakeChartReleaser{
+		chart: helm.Chart{Ref: "myrepo/mychart@1.0.0"},
+		values: helm.Values{
+			"image": map[string]interface{}{"repository": "myrepo/myimage", "tag": "v1"},
+		},
+	}
+	a := &Automator{chart: releaser, history: fakeHistory{}}
+
+	a.onNewImage(Target{"cluster-a", "default", "myapp"}, registry.Image{Digest: "sha256:new"})
+
+	if releaser.applied == nil {
+		t.Fatal("expected Apply to be called")
+	}
+	image, ok := releaser.applied["image"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("applied image value has wrong shape: %+v", releaser.applied["image"])
+	}
+	if want := tagOf(registry.Image{Digest: "sha256:new"}); image["tag"] != want {
+		t.Fatalf("applied image.tag = %v, want %v", image["tag"], want)
+	}
+	if image["repository"] != "myrepo/myimage" {
+		t.Fatalf("applied image.repository should be untouched, got %v", image["repository"])
+	}
+}
+
+func TestOnNewImageWithoutChartClientOnlyLogs(t *testing.T) {
+	a := &Automator{history: fakeHistory{}}
+	// Must not panic with no chart client configured.
+	a.onNewImage(Target{"cluster-a", "default", "myapp"}, registry.Image{Digest: "sha256:new"})
+}
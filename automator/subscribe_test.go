@@ -0,0 +1,61 @@
+package automator
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/fluxy/registry"
+)
+
+// countingRepoWatcher counts Subscribe calls per repo, so the test can
+// fail if Subscribe is called more than once per repo, which is what a
+// polling implementation (re-subscribing, or re-fetching, on every tick)
+// would do; a correct watch subscribes
+// exactly once and then blocks on the channel for as long as the target
+// stays enabled.
+type countingRepoWatcher struct {
+	mu    sync.Mutex
+	calls map[string]int
+	ch    chan []registry.Image
+}
+
+func (w *countingRepoWatcher) Subscribe(repo string) <-chan []registry.Image {
+	w.mu.Lock()
+	w.calls[repo]++
+	w.mu.Unlock()
+	return w.ch
+}
+
+func TestEnableSubscribesOnceAndDeliversWithoutPolling(t *testing.T) {
+	watcher := &countingRepoWatcher{calls: map[string]int{}, ch: make(chan []registry.Image, 1)}
+	a := newTestAutomator("myrepo/myimage:v1", watcher)
+
+	if err := a.Enable("cluster-a", "default", "myapp"); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+
+	// Give the watch goroutine a moment to reach its blocking receive,
+	// then assert no further Subscribe (or anything else) happened on its
+	// own: delivery only ever happens in response to a push on the
+	// channel Subscribe returned, never on a timer.
+	time.Sleep(20 * time.Millisecond)
+	watcher.mu.Lock()
+	n := watcher.calls["myrepo/myimage"]
+	watcher.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("Subscribe called %d times, want exactly 1 (a poller would call it repeatedly, or call Get/Refresh instead)", n)
+	}
+
+	// Pushing a value is the only way onNewImage can observe it; nothing
+	// in the automator drives this on its own.
+	watcher.ch <- []registry.Image{{Digest: "sha256:new"}}
+	time.Sleep(10 * time.Millisecond)
+
+	watcher.mu.Lock()
+	n = watcher.calls["myrepo/myimage"]
+	watcher.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("Subscribe called %d times after delivery, want still 1", n)
+	}
+}
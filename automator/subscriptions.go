@@ -0,0 +1,203 @@
+package automator
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/weaveworks/fluxy/registry"
+	"github.com/weaveworks/fluxy/subscription"
+)
+
+// subscriptionReconciler is the minimal surface of *subscription.Reconciler
+// an Automator needs: the ability to fan a single subscription out across
+// its TargetClusters immediately, rather than waiting for the next resync
+// tick.
+type subscriptionReconciler interface {
+	Reconcile(sub subscription.Subscription)
+}
+
+// subscriptionTarget identifies one automated subscription by namespace
+// and name; subscriptions aren't per-cluster, so unlike Target there's no
+// cluster component.
+type subscriptionTarget struct {
+	Namespace, Name string
+}
+
+func (t subscriptionTarget) String() string {
+	return fmt.Sprintf("%s/%s", t.Namespace, t.Name)
+}
+
+// EnableSubscriptions wires store and reconciler into the automator so
+// that subscriptions can be automated; without this, EnableSubscription
+// always fails. This is separate from NewAutomator because subscriptions
+// are optional: a deployment with no subscription.Store configured still
+// gets plain per-service automation.
+func (a *Automator) EnableSubscriptions(store subscription.Store, reconciler subscriptionReconciler) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.subs = store
+	a.subReconciler = reconciler
+}
+
+// EnableSubscription starts automatically editing the image tag referenced
+// by the named subscription, and fanning the resulting change out across
+// every one of its TargetClusters, whenever a new image appears for its
+// repository. It's idempotent: enabling an already-enabled subscription is
+// a no-op.
+func (a *Automator) EnableSubscription(namespace, name string) error {
+	if a.cache == nil {
+		return fmt.Errorf("automator: no repository cache configured")
+	}
+	if a.subs == nil || a.subReconciler == nil {
+		return fmt.Errorf("automator: no subscription store/reconciler configured, call EnableSubscriptions first")
+	}
+
+	target := subscriptionTarget{namespace, name}
+
+	a.mu.Lock()
+	if _, ok := a.watchingSubs[target]; ok {
+		a.mu.Unlock()
+		return nil
+	}
+	a.mu.Unlock()
+
+	sub, err := a.subs.Get(namespace, name)
+	if err != nil {
+		return err
+	}
+	repo, err := subscriptionRepo(sub)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	a.mu.Lock()
+	a.watchingSubs[target] = stop
+	a.mu.Unlock()
+
+	go a.watchSubscription(target, repo, stop)
+	return nil
+}
+
+// DisableSubscription stops automating the named subscription. Disabling a
+// subscription that isn't enabled is a no-op.
+func (a *Automator) DisableSubscription(namespace, name string) error {
+	target := subscriptionTarget{namespace, name}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stop, ok := a.watchingSubs[target]
+	if !ok {
+		return nil
+	}
+	close(stop)
+	delete(a.watchingSubs, target)
+	return nil
+}
+
+// watchSubscription blocks on repo's subscription channel, bumping the
+// subscription's image tag and fanning it out on every new image, until
+// stop is closed.
+func (a *Automator) watchSubscription(target subscriptionTarget, repo string, stop chan struct{}) {
+	ch := a.cache.Subscribe(repo)
+	for {
+		select {
+		case images, ok := <-ch:
+			if !ok {
+				return
+			}
+			if len(images) == 0 {
+				continue
+			}
+			a.bumpSubscription(target, images[0])
+		case <-stop:
+			return
+		}
+	}
+}
+
+// bumpSubscription re-reads the subscription (in case it changed since it
+// was enabled), edits its image tag, persists it, and reconciles it
+// immediately so the new tag reaches every TargetClusters in one logical
+// operation rather than waiting for the next resync tick.
+func (a *Automator) bumpSubscription(target subscriptionTarget, image registry.Image) {
+	sub, err := a.subs.Get(target.Namespace, target.Name)
+	if err != nil {
+		a.history.LogEvent("", target.Namespace, target.Name, fmt.Sprintf("automator: %v", err))
+		return
+	}
+
+	tag := tagOf(image)
+	switch {
+	case sub.Chart != nil:
+		sub.Chart.Values = bumpImageTag(sub.Chart.Values, tag)
+	default:
+		repo, err := manifestRepo(sub.Manifest)
+		if err != nil {
+			a.history.LogEvent("", target.Namespace, target.Name, fmt.Sprintf("automator: %v", err))
+			return
+		}
+		sub.Manifest = bumpManifestTag(sub.Manifest, repo, tag)
+	}
+
+	if err := a.subs.Put(sub); err != nil {
+		a.history.LogEvent("", target.Namespace, target.Name, fmt.Sprintf("automator: failed to persist bumped subscription: %v", err))
+		return
+	}
+
+	a.history.LogEvent("", target.Namespace, target.Name, fmt.Sprintf("automator: bumped %s to %s, fanning out to %d cluster(s)", target, tag, len(sub.TargetClusters)))
+	a.subReconciler.Reconcile(sub)
+}
+
+// subscriptionRepo returns the image repository a subscription's
+// automation should watch: the chart's image.repository value, or the
+// repository of the manifest's image: field.
+func subscriptionRepo(sub subscription.Subscription) (string, error) {
+	if sub.Chart != nil {
+		image, _ := sub.Chart.Values["image"].(map[string]interface{})
+		repo, _ := image["repository"].(string)
+		if repo == "" {
+			return "", fmt.Errorf("subscription %s: chart has no image.repository value to automate", sub.Name)
+		}
+		return repo, nil
+	}
+	return manifestRepo(sub.Manifest)
+}
+
+// subscriptionImageRe matches the image field of a subscription's raw
+// manifest, the same shape registry.Client's equivalent matches, but kept
+// local since it isn't exported.
+var subscriptionImageRe = regexp.MustCompile(`(?m)^\s*image:\s*(\S+?)(?::\S+)?\s*$`)
+
+func manifestRepo(def []byte) (string, error) {
+	m := subscriptionImageRe.FindSubmatch(def)
+	if m == nil {
+		return "", fmt.Errorf("manifest has no image field to automate")
+	}
+	return string(m[1]), nil
+}
+
+// bumpManifestTag rewrites only the image field whose repository matches
+// repo, replacing its tag; any other container's image is left untouched,
+// the same lesson registry.RewriteDefForPlatforms already had to learn.
+func bumpManifestTag(def []byte, repo, tag string) []byte {
+	matches := subscriptionImageRe.FindAllSubmatchIndex(def, -1)
+
+	var out []byte
+	last := 0
+	var changed bool
+	for _, m := range matches {
+		if string(def[m[2]:m[3]]) != repo {
+			continue
+		}
+		out = append(out, def[last:m[2]]...)
+		out = append(out, []byte(repo+":"+tag)...)
+		last = m[1]
+		changed = true
+	}
+	if !changed {
+		return def
+	}
+	out = append(out, def[last:]...)
+	return out
+}
@@ -0,0 +1,100 @@
+package automator
+
+import (
+	"testing"
+
+	"github.com/weaveworks/fluxy/platform/helm"
+	"github.com/weaveworks/fluxy/registry"
+	"github.com/weaveworks/fluxy/subscription"
+)
+
+// fakeStore is a minimal in-memory subscription.Store for tests.
+type fakeStore struct {
+	subs map[string]subscription.Subscription
+}
+
+func (s *fakeStore) key(namespace, name string) string { return namespace + "/" + name }
+
+func (s *fakeStore) Put(sub subscription.Subscription) error {
+	s.subs[s.key(sub.Namespace, sub.Name)] = sub
+	return nil
+}
+
+func (s *fakeStore) Get(namespace, name string) (subscription.Subscription, error) {
+	sub, ok := s.subs[s.key(namespace, name)]
+	if !ok {
+		return subscription.Subscription{}, subscription.ErrNotFound
+	}
+	return sub, nil
+}
+
+func (s *fakeStore) List(namespace string) ([]subscription.Subscription, error) { return nil, nil }
+
+func (s *fakeStore) Delete(namespace, name string) error {
+	delete(s.subs, s.key(namespace, name))
+	return nil
+}
+
+// fakeSubscriptionReconciler records every subscription it was asked to
+// fan out, so tests can assert reconciliation happens immediately rather
+// than waiting for the next resync tick.
+type fakeSubscriptionReconciler struct {
+	reconciled []subscription.Subscription
+}
+
+func (f *fakeSubscriptionReconciler) Reconcile(sub subscription.Subscription) {
+	f.reconciled = append(f.reconciled, sub)
+}
+
+func TestBumpSubscriptionChartFansOutImmediately(t *testing.T) {
+	store := &fakeStore{subs: map[string]subscription.Subscription{}}
+	reconciler := &fakeSubscriptionReconciler{}
+	store.Put(subscription.Subscription{
+		Namespace: "default",
+		Name:      "myapp",
+		Chart: &subscription.ChartRef{
+			Values: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "myrepo/myimage", "tag": "v1"},
+			},
+		},
+		TargetClusters: []subscription.ClusterSelector{{Cluster: "a"}, {Cluster: "b"}},
+	})
+
+	a := &Automator{history: fakeHistory{}, subs: store, subReconciler: reconciler}
+	a.bumpSubscription(subscriptionTarget{"default", "myapp"}, registry.Image{Digest: "sha256:new"})
+
+	updated, err := store.Get("default", "myapp")
+	if err != nil {
+		t.Fatalf("Get after bump: %v", err)
+	}
+	if got := helm.Values(updated.Chart.Values)["image"].(map[string]interface{})["tag"]; got != tagOf(registry.Image{Digest: "sha256:new"}) {
+		t.Fatalf("image.tag = %v, not bumped", got)
+	}
+
+	if len(reconciler.reconciled) != 1 {
+		t.Fatalf("expected exactly one immediate Reconcile call, got %d", len(reconciler.reconciled))
+	}
+	if len(reconciler.reconciled[0].TargetClusters) != 2 {
+		t.Fatal("expected the reconciled subscription to still target both clusters")
+	}
+}
+
+func TestBumpSubscriptionManifestOnlyChangesMatchingImage(t *testing.T) {
+	store := &fakeStore{subs: map[string]subscription.Subscription{}}
+	reconciler := &fakeSubscriptionReconciler{}
+	store.Put(subscription.Subscription{
+		Namespace: "default",
+		Name:      "myapp",
+		Manifest:  []byte("spec:\n  containers:\n  - name: app\n    image: myrepo/myimage:v1\n  - name: sidecar\n    image: myrepo/logger:v2\n"),
+	})
+
+	a := &Automator{history: fakeHistory{}, subs: store, subReconciler: reconciler}
+	tag := tagOf(registry.Image{Digest: "sha256:new"})
+	a.bumpSubscription(subscriptionTarget{"default", "myapp"}, registry.Image{Digest: "sha256:new"})
+
+	updated, _ := store.Get("default", "myapp")
+	want := "spec:\n  containers:\n  - name: app\n    image: myrepo/myimage:" + tag + "\n  - name: sidecar\n    image: myrepo/logger:v2\n"
+	if string(updated.Manifest) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", updated.Manifest, want)
+	}
+}
@@ -0,0 +1,317 @@
+// Package helm drives chart-based releases through the cluster's Tiller
+// (or Helm 3 SDK-equivalent) installation, as an alternative to applying a
+// raw replication-controller body.
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ErrNoTiller indicates a Client was asked to perform a chart operation
+// without a working connection to the cluster's release server.
+var ErrNoTiller = errors.New("no tiller connection configured")
+
+// ErrChartRefUnsupported is returned for a Chart that names a repository
+// reference rather than supplying packaged Data. Resolving "repo/name@version"
+// references needs a chart-repository index client, which isn't wired up
+// yet; pass a packaged tarball in Data instead.
+var ErrChartRefUnsupported = errors.New("helm: chart repository references are not yet supported; pass a packaged chart in Chart.Data")
+
+// Chart is either a packaged tarball or a reference into a chart
+// repository; exactly one of Data or Ref should be set.
+type Chart struct {
+	// Data is the raw bytes of a packaged chart (.tgz).
+	Data []byte
+	// Ref is a "repo/name@version" reference. The Client does not resolve
+	// it: Render, Diff and Apply return ErrChartRefUnsupported for a Chart
+	// with no Data.
+	Ref string
+}
+
+// Values are the user-supplied overrides merged over the chart's defaults.
+type Values map[string]interface{}
+
+// RenderedManifest is one Kubernetes object produced by rendering a chart,
+// keyed the way Tiller keys them internally ("<kind>/<name>").
+type RenderedManifest struct {
+	Name    string
+	Content []byte
+}
+
+// Applier is the minimal surface of a cluster connection a Client needs in
+// order to apply rendered manifests; kubernetes.Cluster satisfies it.
+type Applier interface {
+	Release(namespace, service string, newDef []byte, updatePeriod time.Duration) error
+}
+
+// revision is one recorded Apply of a chart to a namespace/service.
+type revision struct {
+	number    int
+	chart     Chart
+	values    Values
+	manifests []RenderedManifest
+}
+
+// Client renders and applies Helm charts against a cluster, and is the
+// counterpart of kubernetes.Cluster for the Release path.
+type Client struct {
+	applier Applier
+
+	mu        sync.Mutex
+	revisions map[string][]revision // keyed by "namespace/service"
+}
+
+// NewClient returns a Client that applies rendered charts through applier.
+func NewClient(applier Applier) *Client {
+	return &Client{
+		applier:   applier,
+		revisions: map[string][]revision{},
+	}
+}
+
+// Render renders chart's templates with values layered over the chart's
+// own values.yaml, without installing anything. Templating is plain
+// text/template over top-level keys; charts relying on Sprig functions or
+// subchart dependencies aren't supported yet.
+func (c *Client) Render(namespace, service string, chart Chart, values Values) ([]RenderedManifest, error) {
+	if c == nil {
+		return nil, ErrNoTiller
+	}
+	if len(chart.Data) == 0 {
+		return nil, ErrChartRefUnsupported
+	}
+
+	files, err := untarChart(chart.Data)
+	if err != nil {
+		return nil, fmt.Errorf("helm: reading chart: %v", err)
+	}
+
+	merged := Values{}
+	if raw, ok := files["values.yaml"]; ok {
+		var defaults Values
+		if err := yaml.Unmarshal(raw, &defaults); err != nil {
+			return nil, fmt.Errorf("helm: parsing values.yaml: %v", err)
+		}
+		for k, v := range defaults {
+			merged[k] = v
+		}
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+
+	data := struct {
+		Release struct{ Namespace, Name string }
+		Values  Values
+	}{
+		Values: merged,
+	}
+	data.Release.Namespace = namespace
+	data.Release.Name = service
+
+	var manifests []RenderedManifest
+	for name, raw := range files {
+		if !strings.HasPrefix(name, "templates/") {
+			continue
+		}
+		tmpl, err := template.New(name).Parse(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("helm: parsing %s: %v", name, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("helm: rendering %s: %v", name, err)
+		}
+		manifests = append(manifests, RenderedManifest{Name: name, Content: buf.Bytes()})
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("helm: chart has no templates/ entries")
+	}
+	return manifests, nil
+}
+
+// Diff renders chart and compares it against the manifests recorded for
+// this service's most recent revision, returning a human-readable summary
+// of what would change. Until the platform exposes a way to read live
+// object state, this diffs against our own last-applied record rather than
+// the cluster itself, which is exact as long as nothing but flux touches
+// the release.
+func (c *Client) Diff(namespace, service string, chart Chart, values Values) (string, error) {
+	if c == nil {
+		return "", ErrNoTiller
+	}
+	manifests, err := c.Render(namespace, service, chart, values)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	prev := c.revisions[revisionKey(namespace, service)]
+	c.mu.Unlock()
+
+	var last []RenderedManifest
+	if len(prev) > 0 {
+		last = prev[len(prev)-1].manifests
+	}
+	return diffManifests(last, manifests), nil
+}
+
+// Apply renders chart and applies the result to the cluster, returning the
+// revision number assigned to the resulting release.
+func (c *Client) Apply(namespace, service string, chart Chart, values Values, updatePeriod time.Duration) (revisionNumber int, err error) {
+	if c == nil || c.applier == nil {
+		return 0, ErrNoTiller
+	}
+	manifests, err := c.Render(namespace, service, chart, values)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range manifests {
+		if err := c.applier.Release(namespace, service, m.Content, updatePeriod); err != nil {
+			return 0, fmt.Errorf("helm: applying %s: %v", m.Name, err)
+		}
+	}
+
+	c.mu.Lock()
+	key := revisionKey(namespace, service)
+	revisionNumber = len(c.revisions[key]) + 1
+	c.revisions[key] = append(c.revisions[key], revision{
+		number:    revisionNumber,
+		chart:     chart,
+		values:    values,
+		manifests: manifests,
+	})
+	c.mu.Unlock()
+
+	return revisionNumber, nil
+}
+
+// Rollback reverts service to a previously recorded revision by re-applying
+// the manifests that revision rendered to.
+func (c *Client) Rollback(namespace, service string, revisionNumber int, updatePeriod time.Duration) error {
+	if c == nil || c.applier == nil {
+		return ErrNoTiller
+	}
+	c.mu.Lock()
+	key := revisionKey(namespace, service)
+	var target *revision
+	for i, r := range c.revisions[key] {
+		if r.number == revisionNumber {
+			target = &c.revisions[key][i]
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if target == nil {
+		return fmt.Errorf("helm: no revision %d recorded for %s/%s", revisionNumber, namespace, service)
+	}
+	for _, m := range target.manifests {
+		if err := c.applier.Release(namespace, service, m.Content, updatePeriod); err != nil {
+			return fmt.Errorf("helm: rolling back %s: %v", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// LastRevision returns the chart, values, and revision number most
+// recently applied to namespace/service. It lets a caller (e.g. the
+// automator bumping an image tag) amend the existing release without
+// having to re-supply the whole chart and values from scratch.
+func (c *Client) LastRevision(namespace, service string) (Chart, Values, int, error) {
+	if c == nil {
+		return Chart{}, nil, 0, ErrNoTiller
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	revs := c.revisions[revisionKey(namespace, service)]
+	if len(revs) == 0 {
+		return Chart{}, nil, 0, fmt.Errorf("helm: no revision recorded for %s/%s", namespace, service)
+	}
+	last := revs[len(revs)-1]
+	return last.chart, last.values, last.number, nil
+}
+
+func revisionKey(namespace, service string) string {
+	return namespace + "/" + service
+}
+
+// diffManifests produces a minimal per-manifest added/changed/removed/
+// unchanged summary; it's not a line-level diff.
+func diffManifests(prev, next []RenderedManifest) string {
+	prevByName := map[string][]byte{}
+	for _, m := range prev {
+		prevByName[m.Name] = m.Content
+	}
+	nextByName := map[string][]byte{}
+	for _, m := range next {
+		nextByName[m.Name] = m.Content
+	}
+
+	var lines []string
+	for _, m := range next {
+		old, existed := prevByName[m.Name]
+		switch {
+		case !existed:
+			lines = append(lines, fmt.Sprintf("+ %s", m.Name))
+		case !bytes.Equal(old, m.Content):
+			lines = append(lines, fmt.Sprintf("~ %s", m.Name))
+		default:
+			lines = append(lines, fmt.Sprintf("  %s", m.Name))
+		}
+	}
+	for _, m := range prev {
+		if _, ok := nextByName[m.Name]; !ok {
+			lines = append(lines, fmt.Sprintf("- %s", m.Name))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// untarChart unpacks a gzipped chart tarball into a map of file path
+// (relative to the chart root, e.g. "templates/rc.yaml") to contents.
+func untarChart(data []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Chart archives are rooted in a "<chart-name>/" directory; strip it.
+		name := hdr.Name
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name = name[i+1:]
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+	return files, nil
+}
@@ -0,0 +1,129 @@
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeApplier records every Release call it receives.
+type fakeApplier struct {
+	released []string
+}
+
+func (f *fakeApplier) Release(namespace, service string, newDef []byte, updatePeriod time.Duration) error {
+	f.released = append(f.released, string(newDef))
+	return nil
+}
+
+// packChart builds a gzipped tarball containing the given files under a
+// "mychart/" root, the way a real packaged chart is laid out.
+func packChart(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name: "mychart/" + name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("writing header: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("writing content: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("closing gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func testChart(t *testing.T) Chart {
+	return Chart{Data: packChart(t, map[string]string{
+		"values.yaml":       "image: myrepo/myimage:v1\n",
+		"templates/rc.yaml": "image: {{ .Values.image }}\nname: {{ .Release.Name }}\n",
+	})}
+}
+
+func TestApplyAndRollback(t *testing.T) {
+	applier := &fakeApplier{}
+	c := NewClient(applier)
+	chart := testChart(t)
+
+	rev1, err := c.Apply("default", "myservice", chart, Values{}, 0)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if rev1 != 1 {
+		t.Fatalf("revision = %d, want 1", rev1)
+	}
+	if len(applier.released) != 1 || !strings.Contains(applier.released[0], "myrepo/myimage:v1") {
+		t.Fatalf("applier did not receive rendered manifest: %+v", applier.released)
+	}
+
+	rev2, err := c.Apply("default", "myservice", chart, Values{"image": "myrepo/myimage:v2"}, 0)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if rev2 != 2 {
+		t.Fatalf("revision = %d, want 2", rev2)
+	}
+	if !strings.Contains(applier.released[1], "myrepo/myimage:v2") {
+		t.Fatalf("second apply didn't use overridden value: %+v", applier.released)
+	}
+
+	if err := c.Rollback("default", "myservice", rev1, 0); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	last := applier.released[len(applier.released)-1]
+	if !strings.Contains(last, "myrepo/myimage:v1") {
+		t.Fatalf("rollback didn't re-apply revision 1's manifest: %q", last)
+	}
+
+	if err := c.Rollback("default", "myservice", 99, 0); err == nil {
+		t.Fatal("expected an error rolling back to a nonexistent revision")
+	}
+}
+
+func TestDiffReportsChanges(t *testing.T) {
+	applier := &fakeApplier{}
+	c := NewClient(applier)
+	chart := testChart(t)
+
+	diff, err := c.Diff("default", "myservice", chart, Values{})
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if !strings.HasPrefix(diff, "+ ") {
+		t.Fatalf("expected an addition on first diff, got %q", diff)
+	}
+
+	if _, err := c.Apply("default", "myservice", chart, Values{}, 0); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	diff, err = c.Diff("default", "myservice", chart, Values{"image": "myrepo/myimage:v2"})
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if !strings.HasPrefix(diff, "~ ") {
+		t.Fatalf("expected a change after altering values, got %q", diff)
+	}
+}
+
+func TestRenderRejectsChartRef(t *testing.T) {
+	c := NewClient(&fakeApplier{})
+	if _, err := c.Render("default", "myservice", Chart{Ref: "stable/myapp@1.0.0"}, nil); err != ErrChartRefUnsupported {
+		t.Fatalf("got %v, want ErrChartRefUnsupported", err)
+	}
+}
@@ -0,0 +1,11 @@
+package platform
+
+// NodePlatforms is implemented by a cluster connection that can report the
+// distinct OS/architecture combinations present among its nodes, so callers
+// don't have to specify --platform by hand on every call.
+//
+// kubernetes.Cluster implements this by listing nodes and deduping on
+// status.nodeInfo.architecture and status.nodeInfo.operatingSystem.
+type NodePlatforms interface {
+	NodePlatforms() ([]OCIPlatform, error)
+}
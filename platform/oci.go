@@ -0,0 +1,30 @@
+package platform
+
+// OCIPlatform identifies a single entry in a multi-architecture image index,
+// following the fields used by the OCI image-spec and the older Docker
+// manifest-list format (os, architecture, variant).
+type OCIPlatform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// String renders the platform the way it's commonly written on the command
+// line, e.g. "linux/arm64/v8".
+func (p OCIPlatform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Matches reports whether p satisfies the requested platform. An empty
+// Variant on either side is treated as a wildcard, since most registries
+// don't set one for amd64 images.
+func (p OCIPlatform) Matches(want OCIPlatform) bool {
+	if p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || p.Variant == "" || p.Variant == want.Variant
+}
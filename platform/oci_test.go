@@ -0,0 +1,32 @@
+package platform
+
+import "testing"
+
+func TestOCIPlatformMatches(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		have OCIPlatform
+		want OCIPlatform
+		ok   bool
+	}{
+		{"exact match", OCIPlatform{"linux", "amd64", ""}, OCIPlatform{"linux", "amd64", ""}, true},
+		{"variant wildcard on have", OCIPlatform{"linux", "arm", ""}, OCIPlatform{"linux", "arm", "v7"}, true},
+		{"variant wildcard on want", OCIPlatform{"linux", "arm", "v7"}, OCIPlatform{"linux", "arm", ""}, true},
+		{"variant mismatch", OCIPlatform{"linux", "arm", "v6"}, OCIPlatform{"linux", "arm", "v7"}, false},
+		{"arch mismatch", OCIPlatform{"linux", "amd64", ""}, OCIPlatform{"linux", "arm64", ""}, false},
+		{"os mismatch", OCIPlatform{"linux", "amd64", ""}, OCIPlatform{"windows", "amd64", ""}, false},
+	} {
+		if got := tc.have.Matches(tc.want); got != tc.ok {
+			t.Errorf("%s: %v.Matches(%v) = %v, want %v", tc.name, tc.have, tc.want, got, tc.ok)
+		}
+	}
+}
+
+func TestOCIPlatformString(t *testing.T) {
+	if got, want := (OCIPlatform{"linux", "arm64", "v8"}).String(), "linux/arm64/v8"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got, want := (OCIPlatform{"linux", "amd64", ""}).String(), "linux/amd64"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,22 @@
+package platform
+
+import "time"
+
+// Platform describes what's needed of something that runs services, so
+// that flux.Service doesn't need to know whether it's talking to
+// Kubernetes, Nomad, ECS, or anything else. kubernetes.Cluster is the only
+// implementation today.
+type Platform interface {
+	// Services returns the currently active services in namespace.
+	Services(namespace string) ([]Service, error)
+
+	// ContainersFor returns the containers running a named service.
+	ContainersFor(namespace, service string) ([]Container, error)
+
+	// Release performs a rolling update of service to newDef.
+	Release(namespace, service string, newDef []byte, updatePeriod time.Duration) error
+
+	// Ping checks that the platform is reachable, for use in health checks.
+	// Registry.Get and Registry.GetActive do not call it.
+	Ping() error
+}
@@ -0,0 +1,126 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+)
+
+// ErrNoSuchCluster is returned when a caller names a cluster that isn't
+// present in a Registry.
+var ErrNoSuchCluster = errors.New("no such cluster")
+
+// ErrNoPrimaryCluster is returned by GetActive when no cluster is marked
+// primary and the caller didn't name one explicitly.
+var ErrNoPrimaryCluster = errors.New("no primary cluster configured, and none was specified")
+
+// ClusterConfig describes one cluster entry in a ClusterPlatform config
+// file: enough to connect to it and a couple of defaults.
+type ClusterConfig struct {
+	Name       string `json:"name"`
+	Kubeconfig string `json:"kubeconfig"`
+	Namespace  string `json:"namespace,omitempty"`
+	Primary    bool   `json:"primary,omitempty"`
+
+	// RegistryCreds, keyed by registry host, overrides the credentials
+	// flux would otherwise use when looking up images for this cluster.
+	RegistryCreds map[string]string `json:"registryCreds,omitempty"`
+}
+
+// ClusterPlatformConfig is the root of a multi-cluster config file: the
+// list of clusters flux should know about.
+type ClusterPlatformConfig struct {
+	Clusters []ClusterConfig `json:"clusters"`
+}
+
+// LoadClusterPlatformConfig reads and parses a ClusterPlatformConfig from a
+// YAML or JSON file at path; ghodss/yaml handles both block-style YAML and
+// plain JSON, and respects the `json` struct tags on ClusterConfig.
+func LoadClusterPlatformConfig(path string) (ClusterPlatformConfig, error) {
+	var cfg ClusterPlatformConfig
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Dialer connects to a single cluster described by a ClusterConfig,
+// returning a Platform implementation for it. kubernetes.NewCluster
+// satisfies this once adapted to the (kubeconfig, registryCreds) shape of
+// ClusterConfig.
+type Dialer func(ClusterConfig) (Platform, error)
+
+// NewRegistryFromConfig dials every cluster in cfg via dial and returns a
+// Registry over the results, wiring up ClusterConfig.Primary to the
+// Registry's notion of the primary cluster. It's the bridge between
+// LoadClusterPlatformConfig and NewRegistry: the former only parses the
+// file, the latter only assembles already-connected Platforms.
+func NewRegistryFromConfig(cfg ClusterPlatformConfig, dial Dialer) (*Registry, error) {
+	clusters := make(map[string]Platform, len(cfg.Clusters))
+	primary := ""
+	for _, cc := range cfg.Clusters {
+		p, err := dial(cc)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to cluster %q: %v", cc.Name, err)
+		}
+		clusters[cc.Name] = p
+		if cc.Primary {
+			if primary != "" {
+				return nil, fmt.Errorf("more than one cluster marked primary: %q and %q", primary, cc.Name)
+			}
+			primary = cc.Name
+		}
+	}
+	return NewRegistry(clusters, primary), nil
+}
+
+// Registry holds a set of named clusters, each a Platform, and knows which
+// one (if any) is primary.
+type Registry struct {
+	clusters map[string]Platform
+	primary  string
+}
+
+// NewRegistry returns a Registry over the given named clusters. primary
+// names the cluster GetActive returns when the caller doesn't specify one;
+// it may be empty if no cluster is primary.
+func NewRegistry(clusters map[string]Platform, primary string) *Registry {
+	return &Registry{clusters: clusters, primary: primary}
+}
+
+// Get returns the named cluster.
+func (r *Registry) Get(cluster string) (Platform, error) {
+	p, ok := r.clusters[cluster]
+	if !ok {
+		return nil, ErrNoSuchCluster
+	}
+	return p, nil
+}
+
+// GetActive returns the cluster named by cluster, or, if cluster is empty,
+// the cluster marked primary.
+func (r *Registry) GetActive(cluster string) (string, Platform, error) {
+	if cluster == "" {
+		cluster = r.primary
+	}
+	if cluster == "" {
+		return "", nil, ErrNoPrimaryCluster
+	}
+	p, err := r.Get(cluster)
+	return cluster, p, err
+}
+
+// Clusters returns the names of every registered cluster.
+func (r *Registry) Clusters() []string {
+	names := make([]string, 0, len(r.clusters))
+	for name := range r.clusters {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,49 @@
+package platform
+
+import (
+	"testing"
+	"time"
+)
+
+type fakePlatform struct{ name string }
+
+func (f *fakePlatform) Services(namespace string) ([]Service, error) { return nil, nil }
+func (f *fakePlatform) ContainersFor(namespace, service string) ([]Container, error) {
+	return nil, nil
+}
+func (f *fakePlatform) Release(namespace, service string, newDef []byte, updatePeriod time.Duration) error {
+	return nil
+}
+func (f *fakePlatform) Ping() error { return nil }
+
+func TestRegistryGetActive(t *testing.T) {
+	a, b := &fakePlatform{"a"}, &fakePlatform{"b"}
+	reg := NewRegistry(map[string]Platform{"a": a, "b": b}, "a")
+
+	name, p, err := reg.GetActive("")
+	if err != nil {
+		t.Fatalf("GetActive(\"\"): %v", err)
+	}
+	if name != "a" || p != a {
+		t.Fatalf("GetActive(\"\") = (%q, %v), want (\"a\", a)", name, p)
+	}
+
+	name, p, err = reg.GetActive("b")
+	if err != nil {
+		t.Fatalf("GetActive(\"b\"): %v", err)
+	}
+	if name != "b" || p != b {
+		t.Fatalf("GetActive(\"b\") = (%q, %v), want (\"b\", b)", name, p)
+	}
+
+	if _, _, err := reg.GetActive("nope"); err != ErrNoSuchCluster {
+		t.Fatalf("GetActive(\"nope\") err = %v, want ErrNoSuchCluster", err)
+	}
+}
+
+func TestRegistryGetActiveNoPrimary(t *testing.T) {
+	reg := NewRegistry(map[string]Platform{"a": &fakePlatform{"a"}}, "")
+	if _, _, err := reg.GetActive(""); err != ErrNoPrimaryCluster {
+		t.Fatalf("GetActive(\"\") err = %v, want ErrNoPrimaryCluster", err)
+	}
+}
@@ -0,0 +1,376 @@
+package flux
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/weaveworks/fluxy/history"
+)
+
+// ReleaseStrategy selects how ReleaseProgressively rolls a new definition
+// out. Release itself takes no strategy and always does a rolling update.
+type ReleaseStrategy int
+
+const (
+	// RollingUpdate names what the blocking Release method does: a single
+	// RC is updated in place, pod-by-pod, over updatePeriod.
+	// ReleaseProgressively does not accept it and fails the release with an
+	// unsupported-strategy error.
+	RollingUpdate ReleaseStrategy = iota
+
+	// Canary stands up a second RC at a small percentage of replicas,
+	// and steps it up in stages, checking health between each one.
+	Canary
+
+	// BlueGreen stands up a parallel RC at full scale, waits for it to
+	// become healthy, then releases the new definition to the primary
+	// service through the platform's Release. No service selector is
+	// switched; the parallel RC is scaled to zero after DrainPeriod.
+	BlueGreen
+)
+
+// CanaryOptions configures a Canary release.
+type CanaryOptions struct {
+	// Steps are the replica percentages to progress through, in order,
+	// e.g. []int{10, 25, 50, 100}. Steps must end at (or pass through) 100:
+	// a canary that stalls below full scale is not a completed release, and
+	// runCanary fails rather than reporting success for it.
+	Steps []int
+	// AnalysisWindow is how long to observe Health between steps before
+	// deciding to advance or roll back.
+	AnalysisWindow time.Duration
+	// Health is consulted after each step to decide whether to proceed.
+	Health HealthCheck
+}
+
+// BlueGreenOptions configures a BlueGreen release.
+type BlueGreenOptions struct {
+	// HealthTimeout bounds how long to wait for the green RC to become
+	// healthy before aborting and leaving the old (blue) RC untouched.
+	HealthTimeout time.Duration
+	// DrainPeriod is how long the green RC keeps running after the primary
+	// has been released to the new definition, before the green RC is
+	// scaled to zero. No RC is deleted.
+	DrainPeriod time.Duration
+	Health      HealthCheck
+}
+
+// HealthCheck reports whether a release step is healthy enough to proceed.
+// Implementations might poll an HTTP endpoint, query Prometheus, or check
+// platform.Container readiness.
+type HealthCheck interface {
+	// Healthy is called repeatedly during a canary's analysis window, where
+	// an error return aborts the release and is recorded as the failing
+	// metric in history. During a blue/green health wait an error only
+	// means "not healthy yet": polling continues until HealthTimeout.
+	Healthy(namespace, service string) error
+}
+
+// ReleaseID identifies a single (possibly still in-progress) progressive
+// release, so callers can poll ReleaseStatus or call AbortRelease without
+// blocking on Release itself.
+type ReleaseID string
+
+// ReleaseState is the lifecycle state of a progressive release.
+type ReleaseState string
+
+const (
+	ReleaseStatePending   ReleaseState = "pending"
+	ReleaseStateRunning   ReleaseState = "running"
+	ReleaseStateSucceeded ReleaseState = "succeeded"
+	ReleaseStateFailed    ReleaseState = "failed"
+	ReleaseStateAborted   ReleaseState = "aborted"
+)
+
+// ReleaseStatusReport is what ReleaseStatus returns for a given ReleaseID.
+type ReleaseStatusReport struct {
+	ID    ReleaseID
+	State ReleaseState
+	// Step is not updated as a Canary or BlueGreen release progresses; it
+	// stays 0.
+	Step int
+	// Err is set when State is ReleaseStateFailed.
+	Err string
+}
+
+// ErrNoSuchRelease is returned by ReleaseStatus and AbortRelease for an
+// unknown or expired ReleaseID.
+var ErrNoSuchRelease = errors.New("no such release")
+
+// errAbort is returned by runCanary and runBlueGreen when they notice,
+// between steps, that AbortRelease has closed their abort channel.
+var errAbort = errors.New("release aborted")
+
+// healthPollInterval is how often a health check is polled during a
+// canary's analysis window or a blue/green deploy's health wait.
+const healthPollInterval = 5 * time.Second
+
+// progressiveRelease tracks an in-flight Canary or BlueGreen rollout.
+type progressiveRelease struct {
+	report ReleaseStatusReport
+	abort  chan struct{}
+	// abortOnce guards closing abort, since AbortRelease can be called
+	// more than once (or concurrently) for the same ReleaseID.
+	abortOnce sync.Once
+}
+
+// releaser is the minimal surface of a platform.Platform that Canary and
+// BlueGreen drive directly, letting them be tested against a fake.
+type releaser interface {
+	Release(namespace, service string, newDef []byte, updatePeriod time.Duration) error
+}
+
+// defReplicasRe matches the replicas field of an RC-shaped YAML def.
+var defReplicasRe = regexp.MustCompile(`(?m)^(\s*replicas:\s*)(\d+)\s*$`)
+
+// rewriteReplicas returns def with its replicas field set to n, so a
+// canary or green environment can be scaled independently of the primary.
+func rewriteReplicas(def []byte, n int) []byte {
+	return defReplicasRe.ReplaceAll(def, []byte(fmt.Sprintf("${1}%d", n)))
+}
+
+// readReplicas returns the replicas field of def, or ok=false if it has
+// none (in which case callers should assume a single replica).
+func readReplicas(def []byte) (n int, ok bool) {
+	m := defReplicasRe.FindSubmatch(def)
+	if m == nil {
+		return 0, false
+	}
+	v, err := strconv.Atoi(string(m[2]))
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// canaryServiceName and greenServiceName name the second, parallel RC a
+// Canary or BlueGreen release stands up alongside the primary service.
+func canaryServiceName(service string) string { return service + "-canary" }
+func greenServiceName(service string) string  { return service + "-green" }
+
+func (s *service) releaseStrategy(cluster, namespace, service string, newDef []byte, strategy ReleaseStrategy, canary CanaryOptions, blueGreen BlueGreenOptions) (ReleaseID, error) {
+	cluster, p, err := s.activePlatform(cluster)
+	if err != nil {
+		return "", err
+	}
+
+	id := ReleaseID(namespace + "/" + service + "/" + strconv.FormatUint(nextReleaseSeq(), 10))
+	pr := &progressiveRelease{
+		report: ReleaseStatusReport{ID: id, State: ReleaseStateRunning},
+		abort:  make(chan struct{}),
+	}
+	s.setRelease(id, pr)
+
+	go func() {
+		var err error
+		switch strategy {
+		case Canary:
+			err = s.runCanary(cluster, p, namespace, service, newDef, canary, pr.abort)
+		case BlueGreen:
+			err = s.runBlueGreen(cluster, p, namespace, service, newDef, blueGreen, pr.abort)
+		default:
+			err = errors.New("releaseStrategy: unsupported strategy")
+		}
+
+		switch {
+		case err == errAbort:
+			s.finishRelease(id, ReleaseStateAborted, "")
+			s.history.LogEvent(cluster, namespace, service, "Progressive release aborted")
+		case err != nil:
+			s.finishRelease(id, ReleaseStateFailed, err.Error())
+			s.history.ChangeState(cluster, namespace, service, history.StateFailed)
+			s.history.LogEvent(cluster, namespace, service, "Progressive release failed: "+err.Error())
+		default:
+			s.finishRelease(id, ReleaseStateSucceeded, "")
+			s.history.ChangeState(cluster, namespace, service, history.StateRest)
+			s.history.LogEvent(cluster, namespace, service, "Progressive release succeeded")
+		}
+	}()
+
+	return id, nil
+}
+
+// runCanary stands up a second RC (named service+"-canary") and steps its
+// replica count through opts.Steps as a percentage of the primary's
+// replicas, checking opts.Health against the canary specifically between
+// each step. The canary is scaled to zero as soon as a step fails or the
+// release is aborted, leaving the primary untouched throughout; the final
+// (100%) step promotes the canary's definition to the primary and scales
+// the now-redundant canary RC to zero. If opts.Steps is exhausted without reaching
+// 100%, the canary is left scaled down (via the deferred cleanup) and an
+// error is returned: the primary was never updated, so that's a failed
+// release, not a successful partial one.
+func (s *service) runCanary(cluster string, p releaser, namespace, service string, newDef []byte, opts CanaryOptions, abort <-chan struct{}) (err error) {
+	canaryService := canaryServiceName(service)
+	totalReplicas, ok := readReplicas(newDef)
+	if !ok {
+		totalReplicas = 1
+	}
+
+	cleanupCanary := func() {
+		p.Release(namespace, canaryService, rewriteReplicas(newDef, 0), 0)
+	}
+	defer func() {
+		if err != nil {
+			cleanupCanary()
+		}
+	}()
+
+	for _, step := range opts.Steps {
+		select {
+		case <-abort:
+			return errAbort
+		default:
+		}
+
+		if step >= 100 {
+			if err := p.Release(namespace, service, newDef, 0); err != nil {
+				return err
+			}
+			s.history.LogEvent(cluster, namespace, service, "Canary promoted to 100%")
+			cleanupCanary()
+			return nil
+		}
+
+		canaryReplicas := (totalReplicas*step + 99) / 100
+		if canaryReplicas < 1 {
+			canaryReplicas = 1
+		}
+		s.history.LogEvent(cluster, namespace, service, fmt.Sprintf("Canary step %d%% (%d replicas)", step, canaryReplicas))
+		if err := p.Release(namespace, canaryService, rewriteReplicas(newDef, canaryReplicas), 0); err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(opts.AnalysisWindow)
+		for time.Now().Before(deadline) {
+			select {
+			case <-abort:
+				return errAbort
+			default:
+			}
+			if opts.Health != nil {
+				if err := opts.Health.Healthy(namespace, canaryService); err != nil {
+					return fmt.Errorf("canary at %d%%: %v", step, err)
+				}
+			}
+			time.Sleep(healthPollInterval)
+		}
+	}
+	return fmt.Errorf("canary steps %v completed without a 100%% step; leaving an incomplete rollout running is not a success", opts.Steps)
+}
+
+// runBlueGreen stands up a parallel RC (named service+"-green") at full
+// scale and waits for opts.Health to pass before doing anything to the
+// live (blue) service. Only once green is confirmed healthy does it flip
+// the primary to newDef; if green never becomes healthy within
+// opts.HealthTimeout, the primary is left running the old definition and
+// an error is returned so the release is recorded as failed, not
+// succeeded.
+func (s *service) runBlueGreen(cluster string, p releaser, namespace, service string, newDef []byte, opts BlueGreenOptions, abort <-chan struct{}) error {
+	greenService := greenServiceName(service)
+	scaleDownGreen := func() {
+		p.Release(namespace, greenService, rewriteReplicas(newDef, 0), 0)
+	}
+
+	select {
+	case <-abort:
+		return errAbort
+	default:
+	}
+	if err := p.Release(namespace, greenService, newDef, 0); err != nil {
+		return err
+	}
+
+	healthy := opts.Health == nil
+	if opts.Health != nil {
+		deadline := time.Now().Add(opts.HealthTimeout)
+		for time.Now().Before(deadline) {
+			select {
+			case <-abort:
+				scaleDownGreen()
+				return errAbort
+			default:
+			}
+			if err := opts.Health.Healthy(namespace, greenService); err == nil {
+				healthy = true
+				break
+			}
+			time.Sleep(healthPollInterval)
+		}
+	}
+	if !healthy {
+		scaleDownGreen()
+		return fmt.Errorf("green environment for %s/%s never became healthy within %s", namespace, service, opts.HealthTimeout)
+	}
+
+	// Flip: promote green's definition to the live service.
+	if err := p.Release(namespace, service, newDef, 0); err != nil {
+		return err
+	}
+	time.Sleep(opts.DrainPeriod)
+	scaleDownGreen()
+	return nil
+}
+
+// releaseSeq generates the numeric suffix of a ReleaseID. A plain counter
+// is enough: IDs only need to be unique within one fluxd's lifetime.
+var releaseSeq uint64
+
+func nextReleaseSeq() uint64 {
+	return atomic.AddUint64(&releaseSeq, 1)
+}
+
+func (s *service) setRelease(id ReleaseID, pr *progressiveRelease) {
+	s.releasesMu.Lock()
+	defer s.releasesMu.Unlock()
+	if s.releases == nil {
+		s.releases = map[ReleaseID]*progressiveRelease{}
+	}
+	s.releases[id] = pr
+}
+
+func (s *service) getRelease(id ReleaseID) (*progressiveRelease, bool) {
+	s.releasesMu.Lock()
+	defer s.releasesMu.Unlock()
+	pr, ok := s.releases[id]
+	return pr, ok
+}
+
+func (s *service) finishRelease(id ReleaseID, state ReleaseState, errMsg string) {
+	s.releasesMu.Lock()
+	defer s.releasesMu.Unlock()
+	if pr, ok := s.releases[id]; ok {
+		pr.report.State = state
+		pr.report.Err = errMsg
+	}
+}
+
+// ReleaseProgressively starts a Canary or BlueGreen release and returns
+// immediately with a ReleaseID; use ReleaseStatus to poll progress and
+// AbortRelease to cancel it early. RollingUpdate releases should continue
+// to use the blocking Release method.
+func (s *service) ReleaseProgressively(cluster, namespace, service string, newDef []byte, strategy ReleaseStrategy, canary CanaryOptions, blueGreen BlueGreenOptions) (ReleaseID, error) {
+	return s.releaseStrategy(cluster, namespace, service, newDef, strategy, canary, blueGreen)
+}
+
+func (s *service) ReleaseStatus(id ReleaseID) (ReleaseStatusReport, error) {
+	pr, ok := s.getRelease(id)
+	if !ok {
+		return ReleaseStatusReport{}, ErrNoSuchRelease
+	}
+	return pr.report, nil
+}
+
+func (s *service) AbortRelease(id ReleaseID) error {
+	pr, ok := s.getRelease(id)
+	if !ok {
+		return ErrNoSuchRelease
+	}
+	pr.abortOnce.Do(func() { close(pr.abort) })
+	return nil
+}
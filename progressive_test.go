@@ -0,0 +1,122 @@
+package flux
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weaveworks/fluxy/history"
+)
+
+// fakeReleaser records every Release call made against it.
+type fakeReleaser struct {
+	calls []string
+	defs  [][]byte
+}
+
+func (f *fakeReleaser) Release(namespace, service string, newDef []byte, updatePeriod time.Duration) error {
+	f.calls = append(f.calls, service)
+	f.defs = append(f.defs, newDef)
+	return nil
+}
+
+// fakeHistory only implements what progressive.go calls on history.DB.
+type fakeHistory struct{ history.DB }
+
+func (fakeHistory) LogEvent(cluster, namespace, service, message string) {}
+
+func TestReadReplicas(t *testing.T) {
+	n, ok := readReplicas([]byte("kind: ReplicationController\nspec:\n  replicas: 4\n"))
+	if !ok || n != 4 {
+		t.Fatalf("readReplicas = (%d, %v), want (4, true)", n, ok)
+	}
+
+	if _, ok := readReplicas([]byte("kind: ReplicationController\n")); ok {
+		t.Fatal("expected ok=false for a def with no replicas field")
+	}
+}
+
+func TestRewriteReplicas(t *testing.T) {
+	def := []byte("kind: ReplicationController\nspec:\n  replicas: 4\n")
+	rewritten := rewriteReplicas(def, 1)
+
+	n, ok := readReplicas(rewritten)
+	if !ok || n != 1 {
+		t.Fatalf("after rewrite, readReplicas = (%d, %v), want (1, true)", n, ok)
+	}
+}
+
+func TestCanaryAndGreenServiceNames(t *testing.T) {
+	if got, want := canaryServiceName("foo"), "foo-canary"; got != want {
+		t.Errorf("canaryServiceName(%q) = %q, want %q", "foo", got, want)
+	}
+	if got, want := greenServiceName("foo"), "foo-green"; got != want {
+		t.Errorf("greenServiceName(%q) = %q, want %q", "foo", got, want)
+	}
+}
+
+func TestRunCanaryFailsWithoutReaching100(t *testing.T) {
+	s := &service{history: fakeHistory{}}
+	p := &fakeReleaser{}
+	newDef := []byte("kind: ReplicationController\nspec:\n  replicas: 4\n")
+
+	err := s.runCanary("cluster", p, "default", "myapp", newDef, CanaryOptions{
+		Steps: []int{10, 25, 50},
+	}, make(chan struct{}))
+
+	if err == nil {
+		t.Fatal("expected an error when Steps never reaches 100%")
+	}
+
+	var sawCleanup bool
+	for i, c := range p.calls {
+		if n, ok := readReplicas(p.defs[i]); c == "myapp-canary" && ok && n == 0 {
+			sawCleanup = true
+		}
+		if c == "myapp" {
+			t.Fatal("the primary service should never be released when the canary never reaches 100%")
+		}
+	}
+	if !sawCleanup {
+		t.Fatal("expected the abandoned canary to be cleaned up (scaled to zero replicas)")
+	}
+}
+
+func TestRunCanaryPromotesAt100(t *testing.T) {
+	s := &service{history: fakeHistory{}}
+	p := &fakeReleaser{}
+	newDef := []byte("kind: ReplicationController\nspec:\n  replicas: 4\n")
+
+	err := s.runCanary("cluster", p, "default", "myapp", newDef, CanaryOptions{
+		Steps: []int{100},
+	}, make(chan struct{}))
+
+	if err != nil {
+		t.Fatalf("runCanary: %v", err)
+	}
+
+	var promoted bool
+	for _, c := range p.calls {
+		if c == "myapp" {
+			promoted = true
+		}
+	}
+	if !promoted {
+		t.Fatal("expected the primary service to be released at the 100% step")
+	}
+}
+
+func TestAbortReleaseIsSafeToCallTwice(t *testing.T) {
+	s := &service{}
+	pr := &progressiveRelease{
+		report: ReleaseStatusReport{ID: "r1", State: ReleaseStateRunning},
+		abort:  make(chan struct{}),
+	}
+	s.setRelease("r1", pr)
+
+	if err := s.AbortRelease("r1"); err != nil {
+		t.Fatalf("first AbortRelease: %v", err)
+	}
+	if err := s.AbortRelease("r1"); err != nil {
+		t.Fatalf("second AbortRelease: %v", err)
+	}
+}
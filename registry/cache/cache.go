@@ -0,0 +1,160 @@
+// Package cache keeps an in-memory snapshot of registry repositories so
+// that Images and ServiceImages don't have to hit the registry on every
+// call. A set of background workers keeps the snapshot warm; Get only ever
+// reads from memory, while Refresh fetches from the registry on demand.
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/weaveworks/fluxy/history"
+	"github.com/weaveworks/fluxy/registry"
+)
+
+// DefaultResyncInterval is how often a repository is re-fetched from the
+// registry in the absence of a webhook notification.
+const DefaultResyncInterval = 5 * time.Minute
+
+// NamespacedRepositoryCache holds the most recently fetched image list for
+// every repository flux has been asked about, and refreshes them in the
+// background.
+type NamespacedRepositoryCache struct {
+	client   *registry.Client
+	history  history.DB
+	interval time.Duration
+
+	mu    sync.RWMutex
+	repos map[string][]registry.Image
+	subs  map[string][]chan []registry.Image
+
+	group singleflight.Group
+
+	stop chan struct{}
+}
+
+// New returns a cache that fetches through client, using interval as the
+// default resync period. Call Stop to shut down its background workers.
+func New(client *registry.Client, h history.DB, interval time.Duration) *NamespacedRepositoryCache {
+	if interval <= 0 {
+		interval = DefaultResyncInterval
+	}
+	return &NamespacedRepositoryCache{
+		client:   client,
+		history:  h,
+		interval: interval,
+		repos:    map[string][]registry.Image{},
+		subs:     map[string][]chan []registry.Image{},
+		stop:     make(chan struct{}),
+	}
+}
+
+// Get returns the cached images for repo, if any have been fetched yet.
+func (c *NamespacedRepositoryCache) Get(repo string) ([]registry.Image, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	images, ok := c.repos[repo]
+	return images, ok
+}
+
+// Subscribe returns a channel that receives the repository's image list
+// every time it's refreshed; a subscriber that hasn't yet received the
+// previous list gets only the newest one. The channel is closed when Stop
+// is called.
+func (c *NamespacedRepositoryCache) Subscribe(repo string) <-chan []registry.Image {
+	ch := make(chan []registry.Image, 1)
+	c.mu.Lock()
+	c.subs[repo] = append(c.subs[repo], ch)
+	if images, ok := c.repos[repo]; ok {
+		ch <- images
+	}
+	c.mu.Unlock()
+	return ch
+}
+
+// Refresh fetches repo from the registry immediately, coalescing concurrent
+// calls for the same repository, and updates the cache and any
+// subscribers.
+func (c *NamespacedRepositoryCache) Refresh(repo string) ([]registry.Image, error) {
+	v, err, _ := c.group.Do(repo, func() (interface{}, error) {
+		r, err := c.client.GetRepository(repo)
+		if err != nil {
+			return nil, err
+		}
+		c.set(repo, r.Images)
+		if c.history != nil {
+			// A repository isn't scoped to a cluster or namespace; log it
+			// against the repo name in the service slot, as ServiceImages'
+			// per-container lookups effectively do.
+			c.history.LogEvent("", "", repo, fmt.Sprintf("registry cache repopulated at %s", time.Now().Format(time.RFC3339)))
+		}
+		return r.Images, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]registry.Image), nil
+}
+
+func (c *NamespacedRepositoryCache) set(repo string, images []registry.Image) {
+	c.mu.Lock()
+	c.repos[repo] = images
+	subs := c.subs[repo]
+	c.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- images:
+		default:
+			// Replace the unreceived, older list with this one.
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- images:
+			default:
+			}
+		}
+	}
+}
+
+// Run starts the background resync loop for every repository currently in
+// the cache, plus any added later via Refresh. It blocks until Stop is
+// called, so callers should run it in its own goroutine.
+func (c *NamespacedRepositoryCache) Run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.RLock()
+			repos := make([]string, 0, len(c.repos))
+			for repo := range c.repos {
+				repos = append(repos, repo)
+			}
+			c.mu.RUnlock()
+			for _, repo := range repos {
+				go c.Refresh(repo)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Stop terminates the background resync loop and closes all subscriber
+// channels.
+func (c *NamespacedRepositoryCache) Stop() {
+	close(c.stop)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, chs := range c.subs {
+		for _, ch := range chs {
+			close(ch)
+		}
+	}
+}
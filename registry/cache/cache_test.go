@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/weaveworks/fluxy/registry"
+)
+
+// These tests exercise the cache's bookkeeping (Get/Subscribe/set/Stop)
+// directly, without going through Refresh: registry.Client talks to a real
+// registry and isn't fakeable from this package.
+
+func TestGetMissBeforeSet(t *testing.T) {
+	c := New(nil, nil, 0)
+	if _, ok := c.Get("myrepo"); ok {
+		t.Fatal("Get on an empty cache should miss")
+	}
+}
+
+func TestSetThenGet(t *testing.T) {
+	c := New(nil, nil, 0)
+	images := []registry.Image{{Digest: "sha256:abc"}}
+	c.set("myrepo", images)
+
+	got, ok := c.Get("myrepo")
+	if !ok {
+		t.Fatal("Get after set should hit")
+	}
+	if len(got) != 1 || got[0].Digest != "sha256:abc" {
+		t.Fatalf("Get returned %+v, want %+v", got, images)
+	}
+}
+
+func TestSubscribeReceivesExistingAndFutureUpdates(t *testing.T) {
+	c := New(nil, nil, 0)
+	initial := []registry.Image{{Digest: "sha256:initial"}}
+	c.set("myrepo", initial)
+
+	ch := c.Subscribe("myrepo")
+	select {
+	case got := <-ch:
+		if len(got) != 1 || got[0].Digest != "sha256:initial" {
+			t.Fatalf("got %+v on subscribe, want the already-cached value", got)
+		}
+	default:
+		t.Fatal("Subscribe should deliver the already-cached value immediately")
+	}
+
+	updated := []registry.Image{{Digest: "sha256:updated"}}
+	c.set("myrepo", updated)
+	select {
+	case got := <-ch:
+		if len(got) != 1 || got[0].Digest != "sha256:updated" {
+			t.Fatalf("got %+v after update, want %+v", got, updated)
+		}
+	default:
+		t.Fatal("subscriber should have received the update")
+	}
+}
+
+func TestStopClosesSubscriberChannels(t *testing.T) {
+	c := New(nil, nil, 0)
+	ch := c.Subscribe("myrepo")
+	c.Stop()
+
+	if _, ok := <-ch; ok {
+		t.Fatal("channel should be closed after Stop")
+	}
+}
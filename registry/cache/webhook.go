@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// dockerNotification is the subset of the Docker Registry v2 notification
+// payload (https://docs.docker.com/registry/notifications/) that we care
+// about: which repository a manifest was pushed to.
+type dockerNotification struct {
+	Events []struct {
+		Target struct {
+			Repository string `json:"repository"`
+		} `json:"target"`
+	} `json:"events"`
+}
+
+// WebhookHandler returns an http.Handler for POST /v1/registry/webhook that
+// triggers an immediate Refresh for every repository named in a Docker
+// Registry v2 push notification, instead of waiting for the next resync
+// tick.
+func (c *NamespacedRepositoryCache) WebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var notification dockerNotification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		seen := map[string]bool{}
+		for _, event := range notification.Events {
+			repo := event.Target.Repository
+			if repo == "" || seen[repo] {
+				continue
+			}
+			seen[repo] = true
+			go c.Refresh(repo)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,154 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/weaveworks/fluxy/platform"
+)
+
+// NOTE: Image (defined in image.go, not shown in this tree) gains two fields
+// as part of this change: `Index *Index` and `Digest string`. GetRepository
+// populates Index whenever the registry's manifest content-type is a fat
+// manifest; ResolveImagesForPlatforms below consumes it.
+
+// Manifest media types that indicate a fat manifest (an index over several
+// per-platform manifests) rather than a single image.
+const (
+	mediaTypeOCIImageIndex      = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// PlatformDigest pairs a platform with the digest of the manifest that
+// should be pulled for it.
+type PlatformDigest struct {
+	Platform platform.OCIPlatform
+	Digest   string
+}
+
+// Index is the parsed form of a manifest list / OCI image index: the set of
+// per-platform digests that a tag resolves to. An Image whose tag was
+// published as a fat manifest carries a non-nil Index; single-arch images
+// leave it nil.
+type Index struct {
+	MediaType string
+	Platforms []PlatformDigest
+}
+
+// For returns the digest for the given platform, if the index has one.
+func (idx *Index) For(want platform.OCIPlatform) (string, bool) {
+	if idx == nil {
+		return "", false
+	}
+	for _, pd := range idx.Platforms {
+		if pd.Platform.Matches(want) {
+			return pd.Digest, true
+		}
+	}
+	return "", false
+}
+
+// isFatManifest reports whether the given manifest media type is a
+// multi-platform index, as opposed to a single-image manifest.
+func isFatManifest(mediaType string) bool {
+	return mediaType == mediaTypeOCIImageIndex || mediaType == mediaTypeDockerManifestList
+}
+
+// ResolveImagesForPlatforms narrows each image with a fat-manifest Index down
+// to the digest for the cluster's default platform, platforms[0]. Images
+// without an Index (plain single-arch manifests) are passed through
+// unchanged. It's an error for a required platform to be missing from the
+// index of any image that has one.
+func ResolveImagesForPlatforms(images []Image, platforms []platform.OCIPlatform) ([]Image, error) {
+	resolved := make([]Image, 0, len(images))
+	for _, img := range images {
+		if img.Index == nil {
+			resolved = append(resolved, img)
+			continue
+		}
+		if len(platforms) == 0 {
+			return nil, fmt.Errorf("image %s: no platform given to resolve its index against", img.String())
+		}
+		for _, p := range platforms {
+			if _, ok := img.Index.For(p); !ok {
+				return nil, fmt.Errorf("image %s: no manifest for platform %s", img.String(), p)
+			}
+		}
+		img.Digest, _ = img.Index.For(platforms[0])
+		resolved = append(resolved, img)
+	}
+	return resolved, nil
+}
+
+// defImageRe matches the image field of a replication-controller-shaped
+// YAML def, capturing the "image:" prefix (with its indentation) separately
+// from the reference itself so the reference can be substituted in place.
+var defImageRe = regexp.MustCompile(`(?m)^(\s*image:\s*)(\S+)\s*$`)
+
+// RewriteDefForPlatforms substitutes the tag of the image referenced in a
+// resource definition with the digest matching platforms, failing if the
+// referenced image doesn't publish a manifest for one of them. If the
+// referenced image isn't a fat manifest at all, def is returned unchanged.
+func (c *Client) RewriteDefForPlatforms(def []byte, platforms []platform.OCIPlatform) ([]byte, error) {
+	return rewriteImageRefs(def, func(ref string) ([]byte, error) {
+		return c.resolveRef(ref, platforms)
+	})
+}
+
+// rewriteImageRefs finds every image: field in def and replaces each
+// reference with the result of resolve, splicing each match independently
+// so that a def naming several images (e.g. a sidecar container) has every
+// one resolved on its own terms rather than all stamped with the same
+// replacement.
+func rewriteImageRefs(def []byte, resolve func(ref string) ([]byte, error)) ([]byte, error) {
+	matches := defImageRe.FindAllSubmatchIndex(def, -1)
+	if matches == nil {
+		return nil, fmt.Errorf("registry: no image field found in resource definition")
+	}
+
+	var out []byte
+	last := 0
+	for _, m := range matches {
+		prefix, ref := def[m[2]:m[3]], string(def[m[4]:m[5]])
+
+		newRef, err := resolve(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, def[last:m[2]]...)
+		out = append(out, prefix...)
+		out = append(out, newRef...)
+		last = m[5]
+	}
+	out = append(out, def[last:]...)
+	return out, nil
+}
+
+// resolveRef resolves a single "repo:tag" image reference to its
+// platform-specific digest form ("repo@sha256:..."), or returns ref
+// unchanged if it isn't published as a fat manifest.
+func (c *Client) resolveRef(ref string, platforms []platform.OCIPlatform) ([]byte, error) {
+	image := ParseImage(ref)
+	repo, err := c.GetRepository(image.Repository())
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := ResolveImagesForPlatforms(repo.Images, platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, img := range resolved {
+		if img.String() != ref {
+			continue
+		}
+		if img.Digest == "" {
+			// Not a fat manifest; the tag as given is already correct for
+			// every platform.
+			return []byte(ref), nil
+		}
+		return []byte(image.Repository() + "@" + img.Digest), nil
+	}
+	return nil, fmt.Errorf("registry: image %s not found in repository %s", ref, image.Repository())
+}
@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/weaveworks/fluxy/platform"
+)
+
+func TestResolveImagesForPlatforms(t *testing.T) {
+	linuxAmd64 := platform.OCIPlatform{OS: "linux", Architecture: "amd64"}
+	linuxArm64 := platform.OCIPlatform{OS: "linux", Architecture: "arm64"}
+
+	singleArch := Image{Digest: "sha256:single"}
+	fatManifest := Image{
+		Index: &Index{
+			Platforms: []PlatformDigest{
+				{Platform: linuxAmd64, Digest: "sha256:amd64"},
+				{Platform: linuxArm64, Digest: "sha256:arm64"},
+			},
+		},
+	}
+
+	t.Run("passes through images without an index", func(t *testing.T) {
+		resolved, err := ResolveImagesForPlatforms([]Image{singleArch}, []platform.OCIPlatform{linuxAmd64})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(resolved) != 1 || resolved[0].Digest != "sha256:single" {
+			t.Fatalf("got %+v, want image unchanged", resolved)
+		}
+	})
+
+	t.Run("resolves a fat manifest to the first matching platform", func(t *testing.T) {
+		resolved, err := ResolveImagesForPlatforms([]Image{fatManifest}, []platform.OCIPlatform{linuxArm64})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(resolved) != 1 || resolved[0].Digest != "sha256:arm64" {
+			t.Fatalf("got %+v, want digest sha256:arm64", resolved)
+		}
+	})
+
+	t.Run("errors when no requested platform is in the index", func(t *testing.T) {
+		windows := platform.OCIPlatform{OS: "windows", Architecture: "amd64"}
+		_, err := ResolveImagesForPlatforms([]Image{fatManifest}, []platform.OCIPlatform{windows})
+		if err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+	})
+}
+
+func TestRewriteImageRefsResolvesEachMatchIndependently(t *testing.T) {
+	resolutions := map[string]string{
+		"myrepo/myimage:v1": "myrepo/myimage@sha256:app",
+		"myrepo/logger:v2":  "myrepo/logger@sha256:sidecar",
+	}
+	resolve := func(ref string) ([]byte, error) {
+		newRef, ok := resolutions[ref]
+		if !ok {
+			return nil, fmt.Errorf("unexpected ref %q", ref)
+		}
+		return []byte(newRef), nil
+	}
+
+	def := []byte("spec:\n  containers:\n  - name: app\n    image: myrepo/myimage:v1\n  - name: sidecar\n    image: myrepo/logger:v2\n")
+	out, err := rewriteImageRefs(def, resolve)
+	if err != nil {
+		t.Fatalf("rewriteImageRefs: %v", err)
+	}
+
+	want := "spec:\n  containers:\n  - name: app\n    image: myrepo/myimage@sha256:app\n  - name: sidecar\n    image: myrepo/logger@sha256:sidecar\n"
+	if string(out) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestRewriteImageRefsNoImageField(t *testing.T) {
+	_, err := rewriteImageRefs([]byte("spec:\n  replicas: 1\n"), func(ref string) ([]byte, error) {
+		t.Fatal("resolve should not be called when there's no image field")
+		return nil, nil
+	})
+	if err == nil {
+		t.Fatal("expected an error for a def with no image field")
+	}
+}
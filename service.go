@@ -2,49 +2,118 @@ package flux
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/weaveworks/fluxy/automator"
 	"github.com/weaveworks/fluxy/history"
 	"github.com/weaveworks/fluxy/platform"
-	"github.com/weaveworks/fluxy/platform/kubernetes"
+	"github.com/weaveworks/fluxy/platform/helm"
 	"github.com/weaveworks/fluxy/registry"
+	"github.com/weaveworks/fluxy/registry/cache"
+	"github.com/weaveworks/fluxy/subscription"
 )
 
 // DefaultNamespace is used when no namespace is provided to service methods.
 const DefaultNamespace = "default"
 
-// Service is the flux.Service, i.e. what is implemented by fluxd.
-// It deals in (among other things) services on the platform.
+// Service is the flux.Service, i.e. what is implemented by fluxd. It deals
+// in (among other things) services on the platform. Every method that acts
+// on a cluster takes a cluster name as its first argument; an empty string
+// means "the primary cluster", per platform.Registry.GetActive. Images,
+// ReleaseStatus, AbortRelease and the subscription methods take no cluster.
 type Service interface {
 	// Images returns the images that are available in a repository.
 	// Always in reverse chronological order, i.e. newest first.
 	Images(repository string) ([]registry.Image, error)
 
+	// ImagesForPlatforms is like Images, but resolves any fat manifest
+	// (manifest-list or OCI image index) tags down to the digest for the
+	// first of platforms, failing if such a tag has no manifest for one of
+	// the requested platforms. If platforms is empty, the cluster's own set
+	// of node platforms is detected and used instead.
+	ImagesForPlatforms(cluster, repository string, platforms []platform.OCIPlatform) ([]registry.Image, error)
+
 	// ServiceImages returns a list of (container, images),
 	// representing the running state (the container) along with the
 	// potentially releasable state (the images)
-	ServiceImages(namespace, service string) ([]ContainerImages, error)
+	ServiceImages(cluster, namespace, service string) ([]ContainerImages, error)
+
+	// ServiceImagesForPlatforms is like ServiceImages, but resolves fat
+	// manifest tags to the digest for each requested platform, in the same
+	// manner as ImagesForPlatforms.
+	ServiceImagesForPlatforms(cluster, namespace, service string, platforms []platform.OCIPlatform) ([]ContainerImages, error)
 
 	// Services returns the currently active services on the platform.
-	Services(namespace string) ([]platform.Service, error)
+	Services(cluster, namespace string) ([]platform.Service, error)
 
 	// History returns the release history of one or all services
-	History(namespace, service string) (map[string]history.History, error)
+	History(cluster, namespace, service string) (map[string]history.History, error)
 
 	// Release migrates a service from its current image to a new image, derived
 	// from the newDef definition. Right now, that needs to be the body of a
 	// replication controller. A rolling-update is performed with the provided
 	// updatePeriod. This call blocks until it's complete.
-	Release(namespace, service string, newDef []byte, updatePeriod time.Duration) error
+	Release(cluster, namespace, service string, newDef []byte, updatePeriod time.Duration) error
+
+	// ReleaseToPlatforms is like Release, but resolves the image tag in
+	// newDef to the digest for the first of the given platforms before
+	// releasing.
+	// If a platform in the list has no corresponding entry in the image's
+	// manifest index, the release fails before touching the cluster.
+	ReleaseToPlatforms(cluster, namespace, service string, newDef []byte, updatePeriod time.Duration, platforms []platform.OCIPlatform) error
+
+	// ReleaseProgressively is like Release, but performs a Canary or
+	// BlueGreen rollout instead of a blocking rolling update, and returns
+	// immediately with a ReleaseID. Poll ReleaseStatus for progress, or
+	// call AbortRelease to cancel.
+	ReleaseProgressively(cluster, namespace, service string, newDef []byte, strategy ReleaseStrategy, canary CanaryOptions, blueGreen BlueGreenOptions) (ReleaseID, error)
+
+	// ReleaseStatus reports the current state of a progressive release
+	// started by ReleaseProgressively.
+	ReleaseStatus(id ReleaseID) (ReleaseStatusReport, error)
+
+	// AbortRelease cancels a progressive release between steps; a release
+	// already past its last step completes normally.
+	AbortRelease(id ReleaseID) error
+
+	// ApplySubscription creates or updates a desired-state subscription.
+	// The reconciler picks up the change on its next pass and fans the
+	// subscription's manifest out (with per-cluster Localizations applied)
+	// across its TargetClusters.
+	ApplySubscription(sub subscription.Subscription) error
+
+	// ListSubscriptions returns every subscription in namespace.
+	ListSubscriptions(namespace string) ([]subscription.Subscription, error)
+
+	// DeleteSubscription removes a subscription; it does not tear down
+	// anything already released to its target clusters.
+	DeleteSubscription(namespace, name string) error
+
+	// ReleaseChart installs or upgrades a service from a Helm chart, as an
+	// alternative to the raw replication-controller path. chart must be a
+	// packaged tarball in chart.Data; a chart with only a
+	// "repo/name@version" Ref fails with helm.ErrChartRefUnsupported.
+	// values are merged over the chart's defaults. updatePeriod is how long
+	// to wait between steps of the underlying rolling update that Tiller
+	// performs, the same knob a raw release takes. The resulting revision
+	// number, the values, and a per-manifest diff against the previous
+	// revision are recorded in history, and the revision can later be passed
+	// to Rollback. The chart's name and version are not recorded.
+	ReleaseChart(cluster, namespace, service string, chart helm.Chart, values helm.Values, updatePeriod time.Duration) error
+
+	// Rollback reverts a chart-based release to a previously recorded
+	// revision. It's an error to roll back a service that was last
+	// released via the raw replication-controller path.
+	Rollback(cluster, namespace, service string, revision int) error
 
 	// Automate turns on automatic releases for the given service.
 	// Read the history for the service to check status.
-	Automate(namespace, service string) error
+	Automate(cluster, namespace, service string) error
 
 	// Deautomate turns off automatic releases for the given service.
 	// Read the history for the service to check status.
-	Deautomate(namespace, service string) error
+	Deautomate(cluster, namespace, service string) error
 }
 
 var (
@@ -53,21 +122,60 @@ var (
 	ErrNoPlatformConfigured = errors.New("no platform configured")
 )
 
-// NewService returns a service connected to the provided Kubernetes platform.
-func NewService(reg *registry.Client, k8s *kubernetes.Cluster, auto *automator.Automator, history history.DB) Service {
+// NewService returns a service connected to the given clusters. repoCache
+// may be nil, in which case Images and ServiceImages fall back to fetching
+// the registry directly on every call.
+func NewService(reg *registry.Client, repoCache *cache.NamespacedRepositoryCache, platforms *platform.Registry, hc *helm.Client, auto *automator.Automator, history history.DB, subs subscription.Store) Service {
 	return &service{
-		registry:  reg,
-		platform:  k8s,
-		automator: auto,
-		history:   history,
+		registry:      reg,
+		repoCache:     repoCache,
+		platforms:     platforms,
+		helm:          hc,
+		automator:     auto,
+		history:       history,
+		subscriptions: subs,
 	}
 }
 
 type service struct {
-	registry  *registry.Client
-	platform  *kubernetes.Cluster // TODO(pb): replace with platform.Platform when we have that
-	automator *automator.Automator
-	history   history.DB
+	registry      *registry.Client
+	repoCache     *cache.NamespacedRepositoryCache
+	platforms     *platform.Registry
+	helm          *helm.Client
+	automator     *automator.Automator
+	history       history.DB
+	subscriptions subscription.Store
+
+	releasesMu sync.Mutex
+	releases   map[ReleaseID]*progressiveRelease
+}
+
+// activePlatform resolves cluster to a concrete platform.Platform, using
+// the registry's primary cluster when cluster is empty. It also returns the
+// resolved cluster name, since downstream calls (history, automator) need
+// to key their state on it.
+func (s *service) activePlatform(cluster string) (string, platform.Platform, error) {
+	if s.platforms == nil {
+		return "", nil, ErrNoPlatformConfigured
+	}
+	return s.platforms.GetActive(cluster)
+}
+
+// getRepository returns the image list for repo, preferring the background
+// cache when one is configured and already warm, and falling back to an
+// on-demand registry fetch (which also primes the cache for next time).
+func (s *service) getRepository(repo string) ([]registry.Image, error) {
+	if s.repoCache != nil {
+		if images, ok := s.repoCache.Get(repo); ok {
+			return images, nil
+		}
+		return s.repoCache.Refresh(repo)
+	}
+	r, err := s.registry.GetRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	return r.Images, nil
 }
 
 // ContainerImages describes a combination of a platform container spec, and the
@@ -78,42 +186,47 @@ type ContainerImages struct {
 }
 
 func (s *service) Images(repository string) ([]registry.Image, error) {
-	repo, err := s.registry.GetRepository(repository)
+	return s.getRepository(repository)
+}
+
+func (s *service) ServiceImages(cluster, namespace, service string) ([]ContainerImages, error) {
+	_, p, err := s.activePlatform(cluster)
 	if err != nil {
 		return nil, err
 	}
-	return repo.Images, nil
-}
-
-func (s *service) ServiceImages(namespace, service string) ([]ContainerImages, error) {
-	containers, err := s.platform.ContainersFor(namespace, service)
+	containers, err := p.ContainersFor(namespace, service)
 	if err != nil {
 		return nil, err
 	}
 	var result []ContainerImages
 	for _, container := range containers {
-		repository, err := s.registry.GetRepository(registry.ParseImage(container.Image).Repository())
+		images, err := s.getRepository(registry.ParseImage(container.Image).Repository())
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, ContainerImages{container, repository.Images})
+		result = append(result, ContainerImages{container, images})
 	}
 	return result, nil
 }
 
-func (s *service) Services(namespace string) ([]platform.Service, error) {
-	if s.platform == nil {
-		return nil, ErrNoPlatformConfigured
+func (s *service) Services(cluster, namespace string) ([]platform.Service, error) {
+	_, p, err := s.activePlatform(cluster)
+	if err != nil {
+		return nil, err
 	}
-	return s.platform.Services(namespace)
+	return p.Services(namespace)
 }
 
-func (s *service) History(namespace, service string) (map[string]history.History, error) {
+func (s *service) History(cluster, namespace, service string) (map[string]history.History, error) {
+	cluster, _, err := s.activePlatform(cluster)
+	if err != nil {
+		return nil, err
+	}
 	if service == "" {
-		return s.history.AllEvents(namespace)
+		return s.history.AllEvents(cluster, namespace)
 	}
 
-	h, err := s.history.EventsForService(namespace, service)
+	h, err := s.history.EventsForService(cluster, namespace, service)
 	if err == history.ErrNoHistory {
 		// TODO(pb): not super happy with this
 		h = history.History{
@@ -129,28 +242,193 @@ func (s *service) History(namespace, service string) (map[string]history.History
 	}, nil
 }
 
-func (s *service) Release(namespace, service string, newDef []byte, updatePeriod time.Duration) (err error) {
-	if s.platform == nil {
-		return ErrNoPlatformConfigured
+func (s *service) Release(cluster, namespace, service string, newDef []byte, updatePeriod time.Duration) (err error) {
+	cluster, p, err := s.activePlatform(cluster)
+	if err != nil {
+		return err
+	}
+	s.history.ChangeState(cluster, namespace, service, history.StateInProgress)
+	defer func() {
+		if err != nil {
+			s.history.LogEvent(cluster, namespace, service, "Release failed: "+err.Error())
+		} else {
+			s.history.LogEvent(cluster, namespace, service, "Release succeeded")
+		}
+		s.history.ChangeState(cluster, namespace, service, history.StateRest)
+	}()
+	return p.Release(namespace, service, newDef, updatePeriod)
+}
+
+func (s *service) ImagesForPlatforms(cluster, repository string, platforms []platform.OCIPlatform) ([]registry.Image, error) {
+	platforms, err := s.resolvePlatforms(cluster, platforms)
+	if err != nil {
+		return nil, err
+	}
+	images, err := s.getRepository(repository)
+	if err != nil {
+		return nil, err
+	}
+	return registry.ResolveImagesForPlatforms(images, platforms)
+}
+
+func (s *service) ServiceImagesForPlatforms(cluster, namespace, service string, platforms []platform.OCIPlatform) ([]ContainerImages, error) {
+	platforms, err := s.resolvePlatforms(cluster, platforms)
+	if err != nil {
+		return nil, err
+	}
+	_, p, err := s.activePlatform(cluster)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := p.ContainersFor(namespace, service)
+	if err != nil {
+		return nil, err
+	}
+	var result []ContainerImages
+	for _, container := range containers {
+		repoImages, err := s.getRepository(registry.ParseImage(container.Image).Repository())
+		if err != nil {
+			return nil, err
+		}
+		images, err := registry.ResolveImagesForPlatforms(repoImages, platforms)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ContainerImages{container, images})
+	}
+	return result, nil
+}
+
+// resolvePlatforms returns platforms unchanged if it's non-empty, otherwise
+// auto-detects the platforms present on cluster's nodes.
+func (s *service) resolvePlatforms(cluster string, platforms []platform.OCIPlatform) ([]platform.OCIPlatform, error) {
+	if len(platforms) > 0 {
+		return platforms, nil
+	}
+	_, p, err := s.activePlatform(cluster)
+	if err != nil {
+		return nil, err
+	}
+	detector, ok := p.(platform.NodePlatforms)
+	if !ok {
+		return nil, errors.New("platform does not support node platform detection")
+	}
+	return detector.NodePlatforms()
+}
+
+func (s *service) ReleaseToPlatforms(cluster, namespace, service string, newDef []byte, updatePeriod time.Duration, platforms []platform.OCIPlatform) (err error) {
+	platforms, err = s.resolvePlatforms(cluster, platforms)
+	if err != nil {
+		return err
+	}
+	newDef, err = s.registry.RewriteDefForPlatforms(newDef, platforms)
+	if err != nil {
+		return err
+	}
+	return s.Release(cluster, namespace, service, newDef, updatePeriod)
+}
+
+func (s *service) ReleaseChart(cluster, namespace, service string, chart helm.Chart, values helm.Values, updatePeriod time.Duration) (err error) {
+	if s.helm == nil {
+		return helm.ErrNoTiller
 	}
-	s.history.ChangeState(namespace, service, history.StateInProgress)
+	cluster, _, err = s.activePlatform(cluster)
+	if err != nil {
+		return err
+	}
+	s.history.ChangeState(cluster, namespace, service, history.StateInProgress)
 	defer func() {
 		if err != nil {
-			s.history.LogEvent(namespace, service, "Release failed: "+err.Error())
+			s.history.LogEvent(cluster, namespace, service, "Chart release failed: "+err.Error())
 		} else {
-			s.history.LogEvent(namespace, service, "Release succeeded")
+			s.history.LogEvent(cluster, namespace, service, "Chart release succeeded")
 		}
-		s.history.ChangeState(namespace, service, history.StateRest)
+		s.history.ChangeState(cluster, namespace, service, history.StateRest)
 	}()
-	return s.platform.Release(namespace, service, newDef, updatePeriod)
+
+	diff, err := s.helm.Diff(namespace, service, chart, values)
+	if err != nil {
+		return err
+	}
+	revision, err := s.helm.Apply(namespace, service, chart, values, updatePeriod)
+	if err != nil {
+		return err
+	}
+	return s.history.RecordChartRelease(cluster, namespace, service, history.ChartRelease{
+		Revision: revision,
+		Values:   values,
+		Diff:     diff,
+	})
 }
 
-func (s *service) Automate(namespace, service string) error {
-	s.automator.Enable(namespace, service)
+// ErrNotAChartRelease is returned by Rollback for a service whose most
+// recent release went through the raw replication-controller path rather
+// than ReleaseChart: there's no chart revision history to roll back to.
+var ErrNotAChartRelease = errors.New("flux: service was not released via a chart, nothing to roll back")
+
+func (s *service) Rollback(cluster, namespace, service string, revision int) (err error) {
+	if s.helm == nil {
+		return helm.ErrNoTiller
+	}
+	cluster, _, err = s.activePlatform(cluster)
+	if err != nil {
+		return err
+	}
+	kind, err := s.history.LastReleaseKind(cluster, namespace, service)
+	if err != nil {
+		return err
+	}
+	if kind != history.ReleaseKindChart {
+		return ErrNotAChartRelease
+	}
+
+	s.history.ChangeState(cluster, namespace, service, history.StateInProgress)
+	defer func() {
+		if err != nil {
+			s.history.LogEvent(cluster, namespace, service, "Rollback failed: "+err.Error())
+		} else {
+			s.history.LogEvent(cluster, namespace, service, "Rollback succeeded")
+		}
+		s.history.ChangeState(cluster, namespace, service, history.StateRest)
+	}()
+	return s.helm.Rollback(namespace, service, revision, 0)
+}
+
+func (s *service) Automate(cluster, namespace, service string) error {
+	cluster, _, err := s.activePlatform(cluster)
+	if err != nil {
+		return err
+	}
+	s.automator.Enable(cluster, namespace, service)
 	return nil
 }
 
-func (s *service) Deautomate(namespace, service string) error {
-	s.automator.Disable(namespace, service)
+func (s *service) Deautomate(cluster, namespace, service string) error {
+	cluster, _, err := s.activePlatform(cluster)
+	if err != nil {
+		return err
+	}
+	s.automator.Disable(cluster, namespace, service)
 	return nil
-}
\ No newline at end of file
+}
+
+func (s *service) ApplySubscription(sub subscription.Subscription) error {
+	if s.subscriptions == nil {
+		return errors.New("no subscription store configured")
+	}
+	return s.subscriptions.Put(sub)
+}
+
+func (s *service) ListSubscriptions(namespace string) ([]subscription.Subscription, error) {
+	if s.subscriptions == nil {
+		return nil, errors.New("no subscription store configured")
+	}
+	return s.subscriptions.List(namespace)
+}
+
+func (s *service) DeleteSubscription(namespace, name string) error {
+	if s.subscriptions == nil {
+		return errors.New("no subscription store configured")
+	}
+	return s.subscriptions.Delete(namespace, name)
+}
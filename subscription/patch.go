@@ -0,0 +1,15 @@
+package subscription
+
+import jsonpatch "github.com/evanphx/json-patch"
+
+// applyJSONPatch applies an RFC 6902 JSON patch document to doc.
+func applyJSONPatch(doc, patch []byte) ([]byte, error) {
+	if len(patch) == 0 {
+		return doc, nil
+	}
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Apply(doc)
+}
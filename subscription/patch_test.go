@@ -0,0 +1,34 @@
+package subscription
+
+import "testing"
+
+func TestApplyJSONPatch(t *testing.T) {
+	doc := []byte(`{"image":"foo:1.0","replicas":1}`)
+
+	t.Run("empty patch is a no-op", func(t *testing.T) {
+		got, err := applyJSONPatch(doc, nil)
+		if err != nil {
+			t.Fatalf("applyJSONPatch: %v", err)
+		}
+		if string(got) != string(doc) {
+			t.Fatalf("got %s, want unchanged %s", got, doc)
+		}
+	})
+
+	t.Run("replaces a field", func(t *testing.T) {
+		patch := []byte(`[{"op":"replace","path":"/image","value":"foo:2.0"}]`)
+		got, err := applyJSONPatch(doc, patch)
+		if err != nil {
+			t.Fatalf("applyJSONPatch: %v", err)
+		}
+		if want := `{"image":"foo:2.0","replicas":1}`; string(got) != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	})
+
+	t.Run("invalid patch document errors", func(t *testing.T) {
+		if _, err := applyJSONPatch(doc, []byte(`not json`)); err == nil {
+			t.Fatal("expected an error for a malformed patch")
+		}
+	})
+}
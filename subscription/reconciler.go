@@ -0,0 +1,247 @@
+package subscription
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/fluxy/history"
+	"github.com/weaveworks/fluxy/platform"
+	"github.com/weaveworks/fluxy/platform/helm"
+)
+
+// Releaser is the minimal surface of flux.Service a Reconciler needs to
+// apply a manifest-based Subscription. It's expressed as its own
+// interface, rather than depending on package flux directly, so flux can
+// depend on subscription without an import cycle.
+type Releaser interface {
+	Release(cluster, namespace, service string, newDef []byte, updatePeriod time.Duration) error
+}
+
+// ChartReleaser is the minimal surface of flux.Service a Reconciler needs
+// to apply a chart-based Subscription, for the same reason Releaser exists.
+type ChartReleaser interface {
+	ReleaseChart(cluster, namespace, service string, chart helm.Chart, values helm.Values, updatePeriod time.Duration) error
+}
+
+// DefaultResyncInterval is how often the reconciler compares desired and
+// live state for every subscription, in the absence of a triggering event
+// (e.g. the automator editing an image tag).
+const DefaultResyncInterval = time.Minute
+
+// Reconciler drives live cluster state towards what's declared in a Store,
+// fanning each Subscription out across its TargetClusters.
+type Reconciler struct {
+	store         Store
+	platforms     *platform.Registry
+	releaser      Releaser
+	chartReleaser ChartReleaser
+	history       history.DB
+	interval      time.Duration
+	stop          chan struct{}
+
+	mu          sync.Mutex
+	lastApplied map[string]string
+}
+
+// NewReconciler returns a Reconciler over the given store and clusters.
+// chartReleaser may be nil, in which case chart-based subscriptions are
+// skipped and logged as unsupported.
+func NewReconciler(store Store, platforms *platform.Registry, releaser Releaser, chartReleaser ChartReleaser, h history.DB, interval time.Duration) *Reconciler {
+	if interval <= 0 {
+		interval = DefaultResyncInterval
+	}
+	return &Reconciler{
+		store:         store,
+		platforms:     platforms,
+		releaser:      releaser,
+		chartReleaser: chartReleaser,
+		history:       h,
+		interval:      interval,
+		stop:          make(chan struct{}),
+		lastApplied:   map[string]string{},
+	}
+}
+
+// Run compares desired vs. live state for every subscription on every tick,
+// until Stop is called. It's meant to be run in its own goroutine.
+func (r *Reconciler) Run(namespace string) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.ReconcileAll(namespace)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop terminates the reconcile loop started by Run.
+func (r *Reconciler) Stop() {
+	close(r.stop)
+}
+
+// ReconcileAll reconciles every subscription in namespace immediately.
+func (r *Reconciler) ReconcileAll(namespace string) {
+	subs, err := r.store.List(namespace)
+	if err != nil {
+		return
+	}
+	for _, sub := range subs {
+		r.Reconcile(sub)
+	}
+}
+
+// Reconcile fans sub out across its TargetClusters, applying each
+// cluster's Localization before releasing, and recording the per-cluster
+// outcome in history. A target is skipped, without error, if its localized
+// form is unchanged since the last successful reconcile: the Platform
+// interface has no way to read back live state, so "live" here means "what
+// we last applied", tracked by content hash.
+func (r *Reconciler) Reconcile(sub Subscription) {
+	for _, target := range sub.TargetClusters {
+		if _, err := r.platforms.Get(target.Cluster); err != nil {
+			r.history.LogEvent(target.Cluster, sub.Namespace, sub.Name, fmt.Sprintf("subscription %s: %v", sub.Name, err))
+			continue
+		}
+
+		switch {
+		case sub.Chart != nil:
+			r.reconcileChart(sub, target.Cluster)
+		default:
+			r.reconcileManifest(sub, target.Cluster)
+		}
+	}
+}
+
+func (r *Reconciler) reconcileManifest(sub Subscription, cluster string) {
+	def, err := r.localizeManifest(sub, cluster)
+	if err != nil {
+		r.history.LogEvent(cluster, sub.Namespace, sub.Name, fmt.Sprintf("subscription %s: localization failed: %v", sub.Name, err))
+		return
+	}
+
+	key := reconcileKey(cluster, sub.Namespace, sub.Name)
+	sum := hashBytes(def)
+	if r.unchanged(key, sum) {
+		return
+	}
+
+	if err := r.releaser.Release(cluster, sub.Namespace, sub.Name, def, 0); err != nil {
+		r.history.LogEvent(cluster, sub.Namespace, sub.Name, fmt.Sprintf("subscription %s: release failed: %v", sub.Name, err))
+		return
+	}
+	r.recordApplied(key, sum)
+	r.history.LogEvent(cluster, sub.Namespace, sub.Name, fmt.Sprintf("subscription %s: reconciled", sub.Name))
+}
+
+func (r *Reconciler) reconcileChart(sub Subscription, cluster string) {
+	if r.chartReleaser == nil {
+		r.history.LogEvent(cluster, sub.Namespace, sub.Name, fmt.Sprintf("subscription %s: chart subscriptions are not supported by this reconciler", sub.Name))
+		return
+	}
+
+	values, err := r.localizeChartValues(sub, cluster)
+	if err != nil {
+		r.history.LogEvent(cluster, sub.Namespace, sub.Name, fmt.Sprintf("subscription %s: localization failed: %v", sub.Name, err))
+		return
+	}
+
+	key := reconcileKey(cluster, sub.Namespace, sub.Name)
+	sum, err := hashChart(sub.Chart, values)
+	if err != nil {
+		r.history.LogEvent(cluster, sub.Namespace, sub.Name, fmt.Sprintf("subscription %s: %v", sub.Name, err))
+		return
+	}
+	if r.unchanged(key, sum) {
+		return
+	}
+
+	chart := helm.Chart{Data: sub.Chart.Data, Ref: sub.Chart.Ref}
+	if err := r.chartReleaser.ReleaseChart(cluster, sub.Namespace, sub.Name, chart, values, 0); err != nil {
+		r.history.LogEvent(cluster, sub.Namespace, sub.Name, fmt.Sprintf("subscription %s: release failed: %v", sub.Name, err))
+		return
+	}
+	r.recordApplied(key, sum)
+	r.history.LogEvent(cluster, sub.Namespace, sub.Name, fmt.Sprintf("subscription %s: reconciled", sub.Name))
+}
+
+// localizeManifest returns sub.Manifest with the Localization for cluster
+// (if any) applied as a JSON patch.
+func (r *Reconciler) localizeManifest(sub Subscription, cluster string) ([]byte, error) {
+	def := sub.Manifest
+	loc, ok := findLocalization(sub, cluster)
+	if !ok {
+		return def, nil
+	}
+	return applyJSONPatch(def, loc.Patch)
+}
+
+// localizeChartValues returns sub.Chart.Values with the Localization for
+// cluster (if any) applied as a JSON patch over its JSON encoding.
+func (r *Reconciler) localizeChartValues(sub Subscription, cluster string) (helm.Values, error) {
+	loc, ok := findLocalization(sub, cluster)
+	if !ok {
+		return helm.Values(sub.Chart.Values), nil
+	}
+
+	doc, err := json.Marshal(sub.Chart.Values)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := applyJSONPatch(doc, loc.Patch)
+	if err != nil {
+		return nil, err
+	}
+	var values helm.Values
+	if err := json.Unmarshal(patched, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func findLocalization(sub Subscription, cluster string) (Localization, bool) {
+	for _, loc := range sub.Localizations {
+		if loc.Cluster == cluster {
+			return loc, true
+		}
+	}
+	return Localization{}, false
+}
+
+func reconcileKey(cluster, namespace, name string) string {
+	return cluster + "/" + namespace + "/" + name
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%x", sum)
+}
+
+func hashChart(chart *ChartRef, values helm.Values) (string, error) {
+	doc, err := json.Marshal(struct {
+		Data   []byte
+		Ref    string
+		Values helm.Values
+	}{chart.Data, chart.Ref, values})
+	if err != nil {
+		return "", err
+	}
+	return hashBytes(doc), nil
+}
+
+func (r *Reconciler) unchanged(key, sum string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastApplied[key] == sum
+}
+
+func (r *Reconciler) recordApplied(key, sum string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastApplied[key] = sum
+}
@@ -0,0 +1,188 @@
+package subscription
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weaveworks/fluxy/platform"
+	"github.com/weaveworks/fluxy/platform/helm"
+)
+
+// fakePlatform is the minimal platform.Platform needed to populate a
+// platform.Registry for these tests.
+type fakePlatform struct{}
+
+func (fakePlatform) Services(namespace string) ([]platform.Service, error) { return nil, nil }
+func (fakePlatform) ContainersFor(namespace, service string) ([]platform.Container, error) {
+	return nil, nil
+}
+func (fakePlatform) Release(namespace, service string, newDef []byte, updatePeriod time.Duration) error {
+	return nil
+}
+func (fakePlatform) Ping() error { return nil }
+
+type fakeReleaser struct {
+	calls int
+	last  []byte
+}
+
+func (f *fakeReleaser) Release(cluster, namespace, service string, newDef []byte, updatePeriod time.Duration) error {
+	f.calls++
+	f.last = newDef
+	return nil
+}
+
+type fakeChartReleaser struct {
+	calls int
+	last  helm.Values
+}
+
+func (f *fakeChartReleaser) ReleaseChart(cluster, namespace, service string, chart helm.Chart, values helm.Values, updatePeriod time.Duration) error {
+	f.calls++
+	f.last = values
+	return nil
+}
+
+// fakeHistory only implements what Reconciler calls on history.DB.
+type fakeHistory struct {
+	events []string
+}
+
+func (f *fakeHistory) LogEvent(cluster, namespace, service, message string) {
+	f.events = append(f.events, message)
+}
+
+func testRegistry() *platform.Registry {
+	return platform.NewRegistry(map[string]platform.Platform{"prod": fakePlatform{}}, "prod")
+}
+
+func TestReconcileSkipsUnchangedManifest(t *testing.T) {
+	releaser := &fakeReleaser{}
+	h := &fakeHistory{}
+	r := NewReconciler(nil, testRegistry(), releaser, nil, h, time.Minute)
+
+	sub := Subscription{
+		Name:           "myapp",
+		Namespace:      "default",
+		Manifest:       []byte(`{"image":"foo:1.0"}`),
+		TargetClusters: []ClusterSelector{{Cluster: "prod"}},
+	}
+
+	r.Reconcile(sub)
+	r.Reconcile(sub)
+
+	if releaser.calls != 1 {
+		t.Fatalf("releaser called %d times, want 1 (second reconcile should be a no-op)", releaser.calls)
+	}
+}
+
+func TestReconcileReleasesAgainAfterChange(t *testing.T) {
+	releaser := &fakeReleaser{}
+	h := &fakeHistory{}
+	r := NewReconciler(nil, testRegistry(), releaser, nil, h, time.Minute)
+
+	sub := Subscription{
+		Name:           "myapp",
+		Namespace:      "default",
+		Manifest:       []byte(`{"image":"foo:1.0"}`),
+		TargetClusters: []ClusterSelector{{Cluster: "prod"}},
+	}
+	r.Reconcile(sub)
+
+	sub.Manifest = []byte(`{"image":"foo:2.0"}`)
+	r.Reconcile(sub)
+
+	if releaser.calls != 2 {
+		t.Fatalf("releaser called %d times, want 2 (manifest changed)", releaser.calls)
+	}
+	if string(releaser.last) != string(sub.Manifest) {
+		t.Fatalf("release received %s, want the latest manifest %s", releaser.last, sub.Manifest)
+	}
+}
+
+func TestReconcileAppliesLocalization(t *testing.T) {
+	releaser := &fakeReleaser{}
+	h := &fakeHistory{}
+	r := NewReconciler(nil, testRegistry(), releaser, nil, h, time.Minute)
+
+	sub := Subscription{
+		Name:           "myapp",
+		Namespace:      "default",
+		Manifest:       []byte(`{"image":"foo:1.0"}`),
+		TargetClusters: []ClusterSelector{{Cluster: "prod"}},
+		Localizations: []Localization{
+			{Cluster: "prod", Patch: []byte(`[{"op":"replace","path":"/image","value":"foo:prod"}]`)},
+		},
+	}
+
+	r.Reconcile(sub)
+
+	if want := `{"image":"foo:prod"}`; string(releaser.last) != want {
+		t.Fatalf("released %s, want localized manifest %s", releaser.last, want)
+	}
+}
+
+func TestReconcileSkipsUnknownCluster(t *testing.T) {
+	releaser := &fakeReleaser{}
+	h := &fakeHistory{}
+	r := NewReconciler(nil, testRegistry(), releaser, nil, h, time.Minute)
+
+	sub := Subscription{
+		Name:           "myapp",
+		Namespace:      "default",
+		Manifest:       []byte(`{"image":"foo:1.0"}`),
+		TargetClusters: []ClusterSelector{{Cluster: "staging"}},
+	}
+	r.Reconcile(sub)
+
+	if releaser.calls != 0 {
+		t.Fatalf("releaser called %d times, want 0 for an unregistered cluster", releaser.calls)
+	}
+	if len(h.events) != 1 {
+		t.Fatalf("expected one history event recording the unknown cluster, got %v", h.events)
+	}
+}
+
+func TestReconcileChartWithoutChartReleaserIsSkipped(t *testing.T) {
+	releaser := &fakeReleaser{}
+	h := &fakeHistory{}
+	r := NewReconciler(nil, testRegistry(), releaser, nil, h, time.Minute)
+
+	sub := Subscription{
+		Name:           "myapp",
+		Namespace:      "default",
+		Chart:          &ChartRef{Data: []byte("fake-chart"), Values: map[string]interface{}{"replicas": 1}},
+		TargetClusters: []ClusterSelector{{Cluster: "prod"}},
+	}
+	r.Reconcile(sub)
+
+	if releaser.calls != 0 {
+		t.Fatalf("manifest releaser should never be used for a chart subscription")
+	}
+	if len(h.events) != 1 {
+		t.Fatalf("expected one history event noting charts aren't supported, got %v", h.events)
+	}
+}
+
+func TestReconcileChartReleasesAndSkipsUnchanged(t *testing.T) {
+	chartReleaser := &fakeChartReleaser{}
+	h := &fakeHistory{}
+	r := NewReconciler(nil, testRegistry(), &fakeReleaser{}, chartReleaser, h, time.Minute)
+
+	sub := Subscription{
+		Name:           "myapp",
+		Namespace:      "default",
+		Chart:          &ChartRef{Data: []byte("fake-chart"), Values: map[string]interface{}{"replicas": float64(1)}},
+		TargetClusters: []ClusterSelector{{Cluster: "prod"}},
+	}
+
+	r.Reconcile(sub)
+	r.Reconcile(sub)
+
+	if chartReleaser.calls != 1 {
+		t.Fatalf("chart releaser called %d times, want 1 (second reconcile should be a no-op)", chartReleaser.calls)
+	}
+	if got := chartReleaser.last["replicas"]; got != float64(1) {
+		t.Fatalf("released values = %v, want replicas=1", chartReleaser.last)
+	}
+}
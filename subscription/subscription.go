@@ -0,0 +1,58 @@
+// Package subscription implements declarative desired-state fan-out: a
+// Subscription names a manifest or chart and a set of target clusters, and
+// a reconciler keeps each target's live state matching it.
+package subscription
+
+import "errors"
+
+// ClusterSelector names one cluster a Subscription targets, in the same
+// terms as platform.Registry.
+type ClusterSelector struct {
+	Cluster string
+}
+
+// Localization is a JSON-patch (RFC 6902) applied to the subscription's
+// manifest or chart values for a single target cluster, e.g. to pin a
+// region-specific image tag or a per-environment replica count.
+type Localization struct {
+	Cluster string
+	Patch   []byte // JSON-patch document
+}
+
+// Subscription is a desired-state deployment: a manifest or chart that
+// should exist, in its localized form, on every one of TargetClusters.
+type Subscription struct {
+	Name      string
+	Namespace string
+
+	// Exactly one of Manifest or Chart should be set.
+	Manifest []byte
+	Chart    *ChartRef
+
+	TargetClusters []ClusterSelector
+	Localizations  []Localization
+}
+
+// ChartRef is a Helm chart reference plus its base values, before any
+// per-cluster Localization is applied.
+type ChartRef struct {
+	// Data is the packaged chart (.tgz). Ref-only references into a chart
+	// repository aren't resolved by the reconciler yet; see
+	// helm.ErrChartRefUnsupported.
+	Data   []byte
+	Ref    string
+	Values map[string]interface{}
+}
+
+// ErrNotFound is returned by Store lookups for an unknown subscription.
+var ErrNotFound = errors.New("subscription not found")
+
+// Store persists subscriptions. The reconciler polls it for the current
+// desired state; Service.ApplySubscription and DeleteSubscription write
+// to it, as does the automator when it bumps a subscription's image tag.
+type Store interface {
+	Put(sub Subscription) error
+	Get(namespace, name string) (Subscription, error)
+	List(namespace string) ([]Subscription, error)
+	Delete(namespace, name string) error
+}